@@ -0,0 +1,379 @@
+package cui2vec
+
+import (
+	"errors"
+	"fmt"
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+	"math"
+	"runtime"
+	"sync"
+)
+
+const (
+	defaultQueryBlock     = 256
+	defaultCandidateBlock = 4096
+)
+
+// ErrCancelled is returned by Compute when it is stopped by the Cancel channel of AllPairs.
+var ErrCancelled = errors.New("cancelled")
+
+// kernel is how AllPairs computes the score of a pair of vectors.
+type kernel int
+
+const (
+	// productKernel scores pairs by the product of their (possibly transformed) vectors.
+	productKernel kernel = iota
+	// euclideanKernel derives the Euclidean distance from the product and the norms of the vectors.
+	euclideanKernel
+	// angularKernel derives the Angular distance from the product of normalised vectors.
+	angularKernel
+	// pairwiseKernel computes the metric for each pair of vectors.
+	pairwiseKernel
+)
+
+// Neighbours are the most similar CUIs to a CUI. Concepts holds their scores under the metric, from most to least
+// similar, and Softmax holds the softmax of each of those scores over the scores of every other CUI.
+type Neighbours struct {
+	CUI      string
+	Concepts []Concept
+	Softmax  []float64
+}
+
+// Top keeps at most the k most similar neighbours. A k <= 0 keeps every neighbour.
+func (n Neighbours) Top(k int) Neighbours {
+	if k > 0 && len(n.Concepts) > k {
+		n.Concepts, n.Softmax = n.Concepts[:k], n.Softmax[:k]
+	}
+	return n
+}
+
+// AtLeast keeps only the neighbours with a score under the metric of at least min, such as a minimum Cosine
+// similarity. The softmax scores of the neighbours that are kept are unchanged.
+func (n Neighbours) AtLeast(min float64) Neighbours {
+	i := 0
+	for i < len(n.Concepts) && n.Concepts[i].Value >= min {
+		i++
+	}
+	n.Concepts, n.Softmax = n.Concepts[:i], n.Softmax[:i]
+	return n
+}
+
+// AllPairs finds the most similar CUIs to many CUIs at once. Rather than comparing each pair of vectors in turn,
+// blocks of query vectors are multiplied with blocks of every vector using BLAS, and the best scores of each query
+// are kept in a bounded heap. Memory is bounded by the size of the blocks and the number of workers, rather than by
+// the number of CUIs.
+//
+// Cosine, dot product, Euclidean, Angular and Pearson scores are derived from the products of the vectors. Any other
+// metric is computed pair by pair, but still in blocks.
+type AllPairs struct {
+	// QueryBlock is the number of queries each worker computes at once (default 256).
+	QueryBlock int
+	// CandidateBlock is the number of CUIs a block of queries is multiplied with at once (default 4096).
+	CandidateBlock int
+	// Workers is the number of blocks of queries computed concurrently (default runtime.NumCPU()).
+	Workers int
+	// MinScore, if set, is the least score of a neighbour that is kept, so that with a k <= 0 only the neighbours
+	// that are similar enough are held in memory. The softmax scores are still over the scores of every other CUI.
+	MinScore *float64
+	// Cancel stops Compute when it is closed. Each worker stops before its next block of candidates, so neighbours
+	// that have not been passed to fn are discarded.
+	Cancel <-chan struct{}
+
+	metric  Metric
+	kernel  kernel
+	k       int
+	cuis    []string
+	rows    map[string]int
+	vectors *mat.Dense
+	squares []float64 // the squared norm of each row, for Euclidean distances
+}
+
+// NewAllPairs prepares the vectors of the embeddings for finding the k CUIs most similar to each CUI under a metric.
+// The vectors are copied, so the embeddings may be discarded afterwards.
+func NewAllPairs(v *UncompressedEmbeddings, metric Metric, k int) (*AllPairs, error) {
+	if metric == nil {
+		metric = CosineMetric
+	}
+	d, err := v.valueMatrix()
+	if err != nil {
+		return nil, err
+	}
+	if d.Len() == 0 || d.Dims == 0 {
+		return nil, errors.New("no vectors to compare")
+	}
+
+	a := &AllPairs{
+		metric:  metric,
+		k:       k,
+		cuis:    d.CUIs,
+		rows:    d.Rows,
+		vectors: mat.NewDense(d.Len(), d.Dims, d.Data),
+	}
+	switch metric {
+	case CosineMetric, DotProductMetric, PearsonMetric:
+		a.kernel = productKernel
+	case EuclideanMetric:
+		a.kernel = euclideanKernel
+	case AngularMetric:
+		a.kernel = angularKernel
+	default:
+		a.kernel = pairwiseKernel
+	}
+
+	for i := range a.cuis {
+		row := d.Row(i)
+		switch metric {
+		case PearsonMetric:
+			// Pearson correlation is the Cosine similarity of mean-centred vectors.
+			mean := 0.0
+			for _, x := range row {
+				mean += x
+			}
+			mean /= float64(len(row))
+			for j := range row {
+				row[j] -= mean
+			}
+			fallthrough
+		case CosineMetric, AngularMetric:
+			if n := norm(row, 2); n > 0 {
+				for j := range row {
+					row[j] /= n
+				}
+			}
+		case EuclideanMetric:
+			a.squares = append(a.squares, floats.Dot(row, row))
+		}
+	}
+	return a, nil
+}
+
+// Len is the number of CUIs that are compared.
+func (a *AllPairs) Len() int {
+	return len(a.cuis)
+}
+
+// Dims is the number of dimensions of the vectors that are compared.
+func (a *AllPairs) Dims() int {
+	return a.vectors.RawMatrix().Cols
+}
+
+// score converts the product of the vectors of rows i and j into a score under the metric.
+func (a *AllPairs) score(i, j int, product float64) float64 {
+	switch a.kernel {
+	case euclideanKernel:
+		return -math.Sqrt(math.Max(0, a.squares[i]+a.squares[j]-2*product))
+	case angularKernel:
+		return -math.Acos(math.Max(-1, math.Min(1, product))) / math.Pi
+	}
+	return product
+}
+
+// Compute finds the neighbours of each of the given CUIs, or of every CUI if none are given, and calls fn with the
+// neighbours of each. CUIs without a vector are ignored. fn is never called concurrently, but the CUIs are not
+// passed to it in any particular order. Compute stops at the first error returned by fn, or with ErrCancelled when
+// Cancel is closed.
+func (a *AllPairs) Compute(cuis []string, fn func(Neighbours) error) error {
+	queries := make([]int, 0, len(cuis))
+	for _, cui := range cuis {
+		if i, ok := a.rows[cui]; ok {
+			queries = append(queries, i)
+		}
+	}
+	if cuis == nil {
+		for i := range a.cuis {
+			queries = append(queries, i)
+		}
+	}
+
+	queryBlock, candidateBlock, workers := a.QueryBlock, a.CandidateBlock, a.Workers
+	if queryBlock <= 0 {
+		queryBlock = defaultQueryBlock
+	}
+	if candidateBlock <= 0 {
+		candidateBlock = defaultCandidateBlock
+	}
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if queryBlock > len(queries) {
+		queryBlock = len(queries)
+	}
+	if candidateBlock > len(a.cuis) {
+		candidateBlock = len(a.cuis)
+	}
+	if queryBlock == 0 {
+		return nil
+	}
+	if blocks := (len(queries) + queryBlock - 1) / queryBlock; workers > blocks {
+		workers = blocks
+	}
+
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		once  sync.Once
+		abort error
+	)
+	blocks := make(chan []int)
+	done := make(chan struct{})
+	stop := func(err error) {
+		once.Do(func() {
+			abort = err
+			close(done)
+		})
+	}
+
+	go func() {
+		defer close(blocks)
+		for start := 0; start < len(queries); start += queryBlock {
+			end := start + queryBlock
+			if end > len(queries) {
+				end = len(queries)
+			}
+			select {
+			case blocks <- queries[start:end]:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Each worker reuses the memory for its queries and their products.
+			q := mat.NewDense(queryBlock, a.vectors.RawMatrix().Cols, nil)
+			var products *mat.Dense
+			if a.kernel != pairwiseKernel {
+				products = mat.NewDense(queryBlock, candidateBlock, nil)
+			}
+			for block := range blocks {
+				neighbours, ok := a.block(block, candidateBlock, q, products)
+				if !ok {
+					mu.Lock()
+					stop(ErrCancelled)
+					mu.Unlock()
+					continue
+				}
+				for _, n := range neighbours {
+					mu.Lock()
+					if abort == nil {
+						if err := fn(n); err != nil {
+							stop(err)
+						}
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return abort
+}
+
+// cancelled reports whether Cancel has been closed.
+func (a *AllPairs) cancelled() bool {
+	select {
+	case <-a.Cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// block finds the neighbours of a block of query rows, comparing them with blocks of candidateBlock rows at a time.
+// The queries and their products with each block of rows are stored in q and products. It returns false if Cancel
+// is closed before every block of rows has been compared.
+func (a *AllPairs) block(queries []int, candidateBlock int, q, products *mat.Dense) ([]Neighbours, bool) {
+	dims := a.vectors.RawMatrix().Cols
+	n := a.vectors.RawMatrix().Rows
+	heaps := make([]*topK, len(queries))
+	sums := make([]logSumExp, len(queries))
+	for i, row := range queries {
+		heaps[i] = newTopK(a.k)
+		q.SetRow(i, a.vectors.RawRowView(row))
+	}
+	qv := q.Slice(0, len(queries), 0, dims)
+
+	for start := 0; start < n; start += candidateBlock {
+		if a.cancelled() {
+			return nil, false
+		}
+		end := start + candidateBlock
+		if end > n {
+			end = n
+		}
+		if products != nil {
+			p := products.Slice(0, len(queries), 0, end-start).(*mat.Dense)
+			p.Mul(qv, a.vectors.Slice(start, end, 0, dims).T())
+		}
+		for i, row := range queries {
+			var scores []float64
+			if products != nil {
+				scores = products.RawRowView(i)[:end-start]
+			}
+			for j := start; j < end; j++ {
+				if j == row {
+					continue
+				}
+				var s float64
+				if scores != nil {
+					s = a.score(row, j, scores[j-start])
+				} else {
+					// Metrics that are not derived from products only fail for vectors of unequal lengths.
+					s, _ = a.metric.Similarity(a.vectors.RawRowView(row), a.vectors.RawRowView(j))
+				}
+				if a.MinScore == nil || s >= *a.MinScore {
+					heaps[i].push(Concept{CUI: a.cuis[j], Value: s})
+				}
+				sums[i].add(s)
+			}
+		}
+	}
+
+	neighbours := make([]Neighbours, len(queries))
+	for i, row := range queries {
+		concepts := heaps[i].sorted()
+		softmax := make([]float64, len(concepts))
+		for j, c := range concepts {
+			softmax[j] = sums[i].softmax(c.Value)
+		}
+		neighbours[i] = Neighbours{CUI: a.cuis[row], Concepts: concepts, Softmax: softmax}
+	}
+	return neighbours, true
+}
+
+// SetNeighbours encodes the neighbours of a CUI as its row of the matrix, using the Encoding of the matrix. The matrix
+// is grown to fit the row if it is too small.
+func (v *PrecomputedEmbeddings) SetNeighbours(n Neighbours) error {
+	c, err := CUI2Int(n.CUI)
+	if err != nil {
+		return err
+	}
+	encoding := v.encoding()
+	stride := encoding.Stride()
+
+	row := make([]int, 0, len(n.Concepts)*stride)
+	for i, concept := range n.Concepts {
+		cc, err := CUI2Int(concept.CUI)
+		if err != nil {
+			return err
+		}
+		switch encoding {
+		case EncodingFloat32:
+			row = append(row, cc, int(math.Float32bits(float32(concept.Value))), int(math.Float32bits(float32(n.Softmax[i]))))
+		case EncodingFixedPoint:
+			row = append(row, cc, int(math.Round(n.Softmax[i]*fixedPointScale)))
+		default:
+			return fmt.Errorf("cannot encode scores with the %s encoding", encoding)
+		}
+	}
+
+	for len(v.Matrix) <= c {
+		v.Matrix = append(v.Matrix, nil)
+	}
+	v.Matrix[c] = row
+	return nil
+}
@@ -0,0 +1,103 @@
+package cui2vec
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+)
+
+// AnalogyMethod is a formulation for answering analogies of the form "a is to b as c is to ?".
+type AnalogyMethod int
+
+const (
+	// ThreeCosAdd ranks each candidate d by cos(d, b) - cos(d, a) + cos(d, c).
+	// See: Mikolov, Yih, Zweig (2013) Linguistic Regularities in Continuous Space Word Representations.
+	ThreeCosAdd AnalogyMethod = iota
+	// ThreeCosMul ranks each candidate d by cos(d, b) * cos(d, c) / (cos(d, a) + ε), where each cosine is first
+	// shifted into [0, 1].
+	// See: Levy, Goldberg (2014) Linguistic Regularities in Sparse and Explicit Word Representations.
+	ThreeCosMul
+)
+
+// analogyEpsilon prevents division by zero in ThreeCosMul.
+const analogyEpsilon = 0.001
+
+func (m AnalogyMethod) String() string {
+	switch m {
+	case ThreeCosAdd:
+		return "add"
+	case ThreeCosMul:
+		return "mul"
+	}
+	return fmt.Sprintf("AnalogyMethod(%d)", int(m))
+}
+
+// AnalogyMethodByName returns the analogy method with the given name, either "add" or "mul".
+func AnalogyMethodByName(name string) (AnalogyMethod, error) {
+	switch name {
+	case "add", "3cosadd":
+		return ThreeCosAdd, nil
+	case "mul", "3cosmul":
+		return ThreeCosMul, nil
+	}
+	return 0, fmt.Errorf("unrecognised analogy method %s, must be one of add, mul", name)
+}
+
+// score combines the cosine similarities of a candidate to a, b and c.
+func (m AnalogyMethod) score(a, b, c float64) float64 {
+	if m == ThreeCosMul {
+		a, b, c = (a+1)/2, (b+1)/2, (c+1)/2
+		return b * c / (a + analogyEpsilon)
+	}
+	return b - a + c
+}
+
+// Analogy answers "a is to b as c is to ?" using ThreeCosAdd, returning the k best CUIs. The CUIs a, b and c are
+// never part of the answer. A k <= 0 returns every CUI.
+func (v *UncompressedEmbeddings) Analogy(a, b, c string, k int) ([]Concept, error) {
+	return v.AnalogyWith(a, b, c, k, ThreeCosAdd)
+}
+
+// AnalogyWith answers "a is to b as c is to ?" using the given method, returning the k best CUIs.
+// The CUIs a, b and c are never part of the answer. A k <= 0 returns every CUI.
+func (v *UncompressedEmbeddings) AnalogyWith(a, b, c string, k int, method AnalogyMethod) ([]Concept, error) {
+	var vecs [3][]float64
+	for i, cui := range []string{a, b, c} {
+		vec, ok := v.Embeddings[cui]
+		if !ok {
+			return nil, fmt.Errorf("%s is not in the embeddings", cui)
+		}
+		vecs[i] = vec
+	}
+
+	workers := runtime.NumCPU()
+	heaps := make([]*topK, workers)
+	for i := range heaps {
+		heaps[i] = newTopK(k)
+	}
+
+	var scores [3]func(cui string, vec []float64) (float64, error)
+	for i := range vecs {
+		scores[i] = v.scorer(CosineMetric, vecs[i])
+	}
+
+	v.scan(workers, func(w int, cui string, d []float64) {
+		if cui == a || cui == b || cui == c || len(cui) == 0 {
+			return
+		}
+		var sims [3]float64
+		for i := range scores {
+			sim, err := scores[i](cui, d)
+			if err != nil || math.IsNaN(sim) {
+				return
+			}
+			sims[i] = sim
+		}
+		heaps[w].push(Concept{CUI: cui, Value: method.score(sims[0], sims[1], sims[2])})
+	})
+
+	for i := 1; i < workers; i++ {
+		heaps[0].merge(heaps[i])
+	}
+	return heaps[0].sorted(), nil
+}
@@ -6,15 +6,30 @@ import (
 	"github.com/alexflint/go-arg"
 	"github.com/go-errors/errors"
 	"github.com/hscells/cui2vec"
+	"io"
 	"os"
+	"strings"
 )
 
 type args struct {
 	CUI       string `help:"input cui,required"`
 	Model     string `help:"path to cui2vec model"`
-	Type      string `help:"what kind of cui2vec model is loaded (default/precomputed)"`
+	Type      string `help:"what kind of cui2vec model is loaded (default/precomputed/hnsw/lsh/pq/mmap)"`
 	SkipFirst bool   `help:"skip first line in cui2vec model?"`
+	Format    string `help:"file format of default models (auto/csv/word2vec/npy) (default auto, or csv when --skipfirst is set)"`
+	Vocab     string `help:"path to the vocabulary of npy models (default the model path with .vocab appended)"`
+	Merge     string `help:"how to merge default models given as comma-separated paths (first/average/concatenate) (default first)"`
 	NumCUIS   int    `arg:"-n" help:"number of cuis to output"`
+	Raw       bool   `help:"output the raw scores of the metric rather than their softmax, for default, mmap or float32 precomputed models"`
+	Metric    string `help:"similarity metric for default models (cosine/dot/euclidean/manhattan/angular/pearson)"`
+	Analogy   string `help:"answer the analogy a:b::c:? for default models, given as a,b,c (instead of --cui)"`
+	Method    string `help:"analogy method (add/mul) (default add)"`
+	EfSearch  int    `help:"size of the candidate list when searching hnsw models"`
+	Probes    int    `help:"number of additional buckets to probe per table when searching lsh models"`
+	Convert   string `help:"write the model to this path in the --to format"`
+	To        string `help:"format to convert default models to (hnsw/lsh/pq/word2vec/binary/npy), or precomputed models to (npz)"`
+	Reverse   bool   `help:"list the cuis that have --cui among their nearest neighbours, in precomputed models or the --numcuis nearest neighbours of default models"`
+	Hubness   int    `help:"report the hubness of precomputed or default models, listing this many hubs"`
 	Mapping   string `help:"path to cui mapping"`
 	Verbose   bool   `arg:"-v" help:"verbose output"`
 }
@@ -31,6 +46,129 @@ repository: https://github.com/hscells/cui2vec
 the author of this program is not affiliated with the authors of the paper`
 }
 
+// softmaxEmbeddings are embeddings that can normalise the scores of the k most similar CUIs with softmax.
+type softmaxEmbeddings interface {
+	SimilarKSoftmax(cui string, k int) ([]cui2vec.Concept, error)
+}
+
+// convert writes embeddings to path in the given format, compressed according to the extension of path. The
+// vocabulary of an npy matrix is written next to it, to path with .vocab appended.
+func convert(e cui2vec.KEmbeddings, path, format string) error {
+	if format == "npy" {
+		ue, ok := e.(*cui2vec.UncompressedEmbeddings)
+		if !ok {
+			return errors.New("only default models can be converted to npy")
+		}
+		return create(path, func(matrix io.Writer) error {
+			return create(path+".vocab", func(vocab io.Writer) error {
+				return ue.WriteNumPy(matrix, vocab)
+			})
+		})
+	}
+	return create(path, func(f io.Writer) error {
+		return write(e, f, format)
+	})
+}
+
+// create creates the file at path, compressed according to its extension, and closes it once fn has written to it.
+func create(path string, fn func(w io.Writer) error) error {
+	f, err := cui2vec.CreateCompressed(path, cui2vec.CompressionByExtension(path))
+	if err != nil {
+		return err
+	}
+	err = fn(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// write writes embeddings to w in the given format.
+func write(e cui2vec.KEmbeddings, f io.Writer, format string) error {
+	if format == "npz" {
+		p, ok := e.(*cui2vec.PrecomputedEmbeddings)
+		if !ok {
+			return errors.New("only precomputed models can be converted to npz")
+		}
+		return p.WriteNumPyZ(f)
+	}
+	ue, ok := e.(*cui2vec.UncompressedEmbeddings)
+	if !ok {
+		return errors.Errorf("only default models can be converted to %s", format)
+	}
+	switch format {
+	case "hnsw":
+		h, err := cui2vec.NewHNSWIndex(ue, 0, 0)
+		if err != nil {
+			return err
+		}
+		return h.WriteModel(f)
+	case "lsh":
+		l, err := cui2vec.NewLSHIndex(ue, 0, 0)
+		if err != nil {
+			return err
+		}
+		return l.WriteModel(f)
+	case "pq":
+		p, err := cui2vec.TrainPQEmbeddings(ue, 0, 0)
+		if err != nil {
+			return err
+		}
+		return p.WriteModel(f)
+	case "word2vec":
+		return ue.WriteWord2Vec(f)
+	case "binary":
+		return ue.WriteBinary(f)
+	}
+	return errors.New("unrecognised conversion format")
+}
+
+// mergeModels loads the default models at the given paths, or the shards of a model, and merges them with the
+// named policy.
+func mergeModels(paths []string, policy string) (*cui2vec.UncompressedEmbeddings, error) {
+	p := cui2vec.PreferFirst
+	if len(policy) > 0 {
+		var err error
+		p, err = cui2vec.MergePolicyByName(policy)
+		if err != nil {
+			return nil, err
+		}
+	}
+	m, err := cui2vec.MergeFiles(p, paths...)
+	if err != nil {
+		return nil, err
+	}
+	return m.UncompressedEmbeddings, nil
+}
+
+// loadNumPy loads an npy matrix of the model at path, using the vocabulary next to it unless another is given.
+func loadNumPy(matrix io.Reader, path, vocab string) (*cui2vec.UncompressedEmbeddings, error) {
+	if len(vocab) == 0 {
+		vocab = path + ".vocab"
+	}
+	f, err := os.Open(vocab)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return cui2vec.NewNumPyEmbeddings(matrix, f)
+}
+
+// reverseIndex indexes the neighbours of a precomputed model, or the k nearest neighbours of every CUI of a default
+// model (10 if k is not given).
+func reverseIndex(e cui2vec.KEmbeddings, k int) (*cui2vec.ReverseIndex, error) {
+	switch m := e.(type) {
+	case *cui2vec.PrecomputedEmbeddings:
+		return cui2vec.NewReverseIndex(m)
+	case *cui2vec.UncompressedEmbeddings:
+		if k <= 0 {
+			k = 10
+		}
+		return cui2vec.NewReverseIndexFromEmbeddings(m, m.Metric, k)
+	}
+	return nil, errors.New("reverse neighbours require a precomputed or default model")
+}
+
 func main() {
 	var args args
 	arg.MustParse(&args)
@@ -40,43 +178,174 @@ func main() {
 			fmt.Println("loading model...")
 		}
 
-		f, err := os.OpenFile(args.Model, os.O_RDONLY, os.ModePerm)
-		if err != nil {
-			panic(err)
+		// Several default models, or every shard of a sharded model, are loaded and merged.
+		paths := strings.Split(args.Model, ",")
+		merge := len(paths) > 1
+		if args.Type == "default" && !merge {
+			_, sharded, err := cui2vec.ShardPaths(args.Model)
+			if err != nil {
+				panic(err)
+			}
+			merge = sharded
+		}
+		if merge && args.Type != "default" {
+			panic(errors.New("only default models can be merged"))
+		}
+		if merge && ((len(args.Format) > 0 && args.Format != "auto") || args.SkipFirst) {
+			panic(errors.New("the format of merged models is always detected, so --format and --skipfirst cannot be given"))
 		}
 
-		var e cui2vec.Embeddings
+		var f *os.File
+		var err error
+		if !merge {
+			f, err = os.OpenFile(args.Model, os.O_RDONLY, os.ModePerm)
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		var e cui2vec.KEmbeddings
 		if args.Type == "default" {
-			e, err = cui2vec.NewUncompressedEmbeddings(f, args.SkipFirst, ',')
+			var ue *cui2vec.UncompressedEmbeddings
+			if merge {
+				ue, err = mergeModels(paths, args.Merge)
+			} else {
+				// The header row is only that of csv models, so giving --skipfirst skips detection.
+				if len(args.Format) == 0 && args.SkipFirst {
+					args.Format = "csv"
+				}
+				switch args.Format {
+				case "", "auto":
+					var format cui2vec.Format
+					ue, format, err = cui2vec.LoadEmbeddings(f)
+					if args.Verbose {
+						fmt.Println("detected format", format)
+					}
+				case "csv":
+					ue, err = cui2vec.NewUncompressedEmbeddings(f, args.SkipFirst, ',')
+				case "word2vec":
+					ue, err = cui2vec.NewWord2VecEmbeddings(f)
+				case "npy":
+					ue, err = loadNumPy(f, args.Model, args.Vocab)
+				default:
+					err = errors.New("unrecognised model format")
+				}
+			}
 			if err != nil {
 				panic(err)
 			}
+			if len(args.Metric) > 0 {
+				ue.Metric, err = cui2vec.MetricByName(args.Metric)
+				if err != nil {
+					panic(err)
+				}
+			}
+			e = ue
 		} else if args.Type == "precomputed" {
 			e, err = cui2vec.NewPrecomputedEmbeddings(f)
 			if err != nil {
 				panic(err)
 			}
+		} else if args.Type == "hnsw" {
+			h, err := cui2vec.LoadHNSWIndex(f)
+			if err != nil {
+				panic(err)
+			}
+			if args.EfSearch > 0 {
+				h.EfSearch = args.EfSearch
+			}
+			e = h
+		} else if args.Type == "lsh" {
+			l, err := cui2vec.LoadLSHIndex(f)
+			if err != nil {
+				panic(err)
+			}
+			if args.Probes > 0 {
+				l.Probes = args.Probes
+			}
+			e = l
+		} else if args.Type == "pq" {
+			e, err = cui2vec.NewPQEmbeddings(f)
+			if err != nil {
+				panic(err)
+			}
+		} else if args.Type == "mmap" {
+			m, err := cui2vec.OpenMappedEmbeddings(args.Model)
+			if err != nil {
+				panic(err)
+			}
+			defer m.Close()
+			e = m
 		} else {
 			panic(errors.New("unrecognised model type"))
 		}
 
-		if args.Verbose {
-			fmt.Println("computing similarity...")
-		}
-		concepts, err := e.Similar(args.CUI)
-		if err != nil {
-			panic(err)
+		if len(args.Convert) > 0 {
+			if args.Verbose {
+				fmt.Printf("converting model to %s...\n", args.To)
+			}
+			err = convert(e, args.Convert, args.To)
+			if err != nil {
+				panic(err)
+			}
+			return
 		}
 
-		if args.NumCUIS > 0 {
-			// Resize the slice.
+		if args.Reverse || args.Hubness > 0 {
 			if args.Verbose {
-				fmt.Println("resizing slice...")
+				fmt.Println("indexing neighbours...")
+			}
+			r, err := reverseIndex(e, args.NumCUIS)
+			if err != nil {
+				panic(err)
+			}
+			var v interface{}
+			if args.Reverse {
+				v, err = r.ReverseSimilar(args.CUI)
+				if err != nil {
+					panic(err)
+				}
+			} else {
+				v = r.Hubness(args.Hubness)
+			}
+			if err := json.NewEncoder(os.Stdout).Encode(v); err != nil {
+				panic(err)
 			}
+			return
+		}
 
-			if len(concepts) > args.NumCUIS {
-				concepts = concepts[:args.NumCUIS]
+		if args.Verbose {
+			fmt.Println("computing similarity...")
+		}
+		var concepts []cui2vec.Concept
+		if len(args.Analogy) > 0 {
+			ue, ok := e.(*cui2vec.UncompressedEmbeddings)
+			if !ok {
+				panic(errors.New("analogies require a default model"))
+			}
+			abc := strings.Split(args.Analogy, ",")
+			if len(abc) != 3 {
+				panic(errors.New("analogy must be given as three comma-separated cuis"))
+			}
+			method := cui2vec.ThreeCosAdd
+			if len(args.Method) > 0 {
+				method, err = cui2vec.AnalogyMethodByName(args.Method)
+				if err != nil {
+					panic(err)
+				}
 			}
+			concepts, err = ue.AnalogyWith(abc[0], abc[1], abc[2], args.NumCUIS, method)
+		} else if se, ok := e.(softmaxEmbeddings); ok && !args.Raw {
+			// Scores are normalised with softmax over every CUI, as they always have been.
+			concepts, err = se.SimilarKSoftmax(args.CUI, args.NumCUIS)
+		} else {
+			if pe, ok := e.(*cui2vec.PrecomputedEmbeddings); ok && args.Raw {
+				pe.Score = cui2vec.ScoreRaw
+			}
+			concepts, err = e.SimilarK(args.CUI, args.NumCUIS)
+		}
+		if err != nil {
+			panic(err)
 		}
 
 		b, err := json.Marshal(concepts)
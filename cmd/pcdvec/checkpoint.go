@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/hscells/cui2vec"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	checkpointMagic   = "C2VK"
+	checkpointVersion = 4
+)
+
+// checkpointHeader describes the run that a checkpoint was written by. A checkpoint can only be resumed by a run with
+// the same header, so that the resumed rows are the same as those that would have been computed.
+type checkpointHeader struct {
+	Cols     uint32
+	Encoding uint32
+	Metric   string
+	Model    uint64 // the fingerprint of the model
+	Shard    uint32
+	Shards   uint32
+	Rows     uint32
+	MinScore float64 // the least score of a concept, or -Inf
+	Counts   uint64  // the hash of the file of counts of concepts, or zero
+	Queries  uint64  // the hash of the CUIs whose rows are computed, which differ with --filter
+}
+
+func (h checkpointHeader) String() string {
+	return fmt.Sprintf("%d columns of %s %s scores of at least %g for %d rows %016x of shard %d/%d of model %016x with counts %016x",
+		h.Cols, cui2vec.Encoding(h.Encoding), h.Metric, h.MinScore, h.Rows, h.Queries, h.Shard, h.Shards, h.Model, h.Counts)
+}
+
+// size is the number of bytes of the header in a checkpoint.
+func (h checkpointHeader) size() int64 {
+	return int64(len(checkpointMagic) + 4*6 + 8*4 + 2 + len(h.Metric))
+}
+
+// hashCUIs identifies the CUIs whose rows are computed by a run, in any order.
+func hashCUIs(cuis []string) uint64 {
+	sorted := append([]string(nil), cuis...)
+	sort.Strings(sorted)
+	h := fnv.New64a()
+	for _, cui := range sorted {
+		io.WriteString(h, cui)
+		h.Write([]byte{'\n'})
+	}
+	return h.Sum64()
+}
+
+// checkpoint records the rows of the matrix as they are computed, so that an interrupted run can be resumed. The file
+// begins with a header, followed by a record for each row: the CUI of the row, the number of columns, the columns,
+// and the CRC32 of the record, all as little-endian uint32s. Rows are buffered, and flushed to disk at intervals.
+type checkpoint struct {
+	path     string
+	f        *os.File
+	w        *bufio.Writer
+	interval time.Duration
+	flushed  time.Time
+}
+
+// createCheckpoint creates a checkpoint for a run, replacing any existing checkpoint at path.
+func createCheckpoint(path string, h checkpointHeader, interval time.Duration) (*checkpoint, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	c := &checkpoint{path: path, f: f, w: bufio.NewWriter(f), interval: interval, flushed: time.Now()}
+	if err := writeCheckpointHeader(c.w, h); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := c.flush(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// resumeCheckpoint reads the rows recorded by the checkpoint at path into pe, and opens the checkpoint to record more
+// rows. The checkpoint must have been written by a run with the same header. A row that was only partly written
+// when the run was interrupted is discarded. It returns the number of rows that were read.
+func resumeCheckpoint(path string, h checkpointHeader, pe *cui2vec.PrecomputedEmbeddings, interval time.Duration) (*checkpoint, int, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	br := bufio.NewReader(f)
+	found, err := readCheckpointHeader(br)
+	if err != nil {
+		f.Close()
+		return nil, 0, fmt.Errorf("%s: %v", path, err)
+	}
+	if found != h {
+		f.Close()
+		return nil, 0, fmt.Errorf("%s was written for %s, but this run is for %s", path, found, h)
+	}
+
+	// The offset of the end of the last complete row.
+	offset := h.size()
+	rows := 0
+	for {
+		cui, row, err := readCheckpointRow(br)
+		if err != nil {
+			break
+		}
+		for len(pe.Matrix) <= cui {
+			pe.Matrix = append(pe.Matrix, nil)
+		}
+		pe.Matrix[cui] = row
+		offset += int64(4 * (len(row) + 3))
+		rows++
+	}
+
+	// Anything after the last complete row is discarded, and new rows are appended in its place.
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return &checkpoint{path: path, f: f, w: bufio.NewWriter(f), interval: interval, flushed: time.Now()}, rows, nil
+}
+
+// add records a row, and flushes the checkpoint if it has not been flushed for longer than the interval.
+func (c *checkpoint) add(cui int, row []int) error {
+	b := make([]byte, 4*(len(row)+3))
+	binary.LittleEndian.PutUint32(b, uint32(cui))
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(row)))
+	for i, x := range row {
+		binary.LittleEndian.PutUint32(b[8+4*i:], uint32(x))
+	}
+	binary.LittleEndian.PutUint32(b[len(b)-4:], crc32.ChecksumIEEE(b[:len(b)-4]))
+	if _, err := c.w.Write(b); err != nil {
+		return err
+	}
+	if time.Since(c.flushed) >= c.interval {
+		return c.flush()
+	}
+	return nil
+}
+
+// flush writes the buffered rows to disk.
+func (c *checkpoint) flush() error {
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	c.flushed = time.Now()
+	return c.f.Sync()
+}
+
+// close flushes the checkpoint and closes the file.
+func (c *checkpoint) close() error {
+	err := c.flush()
+	if cerr := c.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeCheckpointHeader writes the magic bytes and version of a checkpoint, followed by the header of the run.
+func writeCheckpointHeader(w io.Writer, h checkpointHeader) error {
+	if _, err := io.WriteString(w, checkpointMagic); err != nil {
+		return err
+	}
+	for _, x := range []interface{}{uint32(checkpointVersion), h.Cols, h.Encoding, h.Model, h.Shard, h.Shards, h.Rows, h.MinScore, h.Counts, h.Queries} {
+		if err := binary.Write(w, binary.LittleEndian, x); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint16(len(h.Metric))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, h.Metric)
+	return err
+}
+
+// readCheckpointHeader reads the header of a checkpoint, checking its magic bytes and version.
+func readCheckpointHeader(r io.Reader) (checkpointHeader, error) {
+	var h checkpointHeader
+	magic := make([]byte, len(checkpointMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return h, err
+	}
+	if string(magic) != checkpointMagic {
+		return h, errors.New("not a pcdvec checkpoint")
+	}
+	var version uint32
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return h, err
+	}
+	if version != checkpointVersion {
+		return h, fmt.Errorf("unsupported checkpoint version %d", version)
+	}
+	for _, x := range []interface{}{&h.Cols, &h.Encoding, &h.Model, &h.Shard, &h.Shards, &h.Rows, &h.MinScore, &h.Counts, &h.Queries} {
+		if err := binary.Read(r, binary.LittleEndian, x); err != nil {
+			return h, err
+		}
+	}
+	var n uint16
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return h, err
+	}
+	metric := make([]byte, n)
+	if _, err := io.ReadFull(r, metric); err != nil {
+		return h, err
+	}
+	h.Metric = string(metric)
+	return h, nil
+}
+
+// readCheckpointRow reads the next complete row of a checkpoint.
+func readCheckpointRow(r io.Reader) (int, []int, error) {
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, err
+	}
+	cui := int(binary.LittleEndian.Uint32(b))
+	n := int(binary.LittleEndian.Uint32(b[4:]))
+	// A corrupt length would otherwise allocate a very large row.
+	if n > 1<<20 {
+		return 0, nil, errors.New("corrupt row length")
+	}
+	b = append(b, make([]byte, 4*(n+1))...)
+	if _, err := io.ReadFull(r, b[8:]); err != nil {
+		return 0, nil, err
+	}
+	if crc32.ChecksumIEEE(b[:len(b)-4]) != binary.LittleEndian.Uint32(b[len(b)-4:]) {
+		return 0, nil, errors.New("corrupt row")
+	}
+	row := make([]int, n)
+	for i := range row {
+		row[i] = int(binary.LittleEndian.Uint32(b[8+4*i:]))
+	}
+	return cui, row, nil
+}
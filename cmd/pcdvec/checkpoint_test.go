@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/hscells/cui2vec"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setup loads a synthetic model of n CUIs, and creates the matrix and checkpoint header that pcdvec would for it.
+func setup(t *testing.T, n int, sel selection) (*cui2vec.AllPairs, []string, func() *cui2vec.PrecomputedEmbeddings, checkpointHeader) {
+	rng := rand.New(rand.NewSource(1))
+	var b strings.Builder
+	for i := 1; i <= n; i++ {
+		b.WriteString(cui2vec.Int2CUI(i))
+		for j := 0; j < 8; j++ {
+			b.WriteString(fmt.Sprintf(",%f", rng.NormFloat64()))
+		}
+		b.WriteString("\n")
+	}
+	ue := &cui2vec.UncompressedEmbeddings{Comma: ',', DropCUIColumn: true}
+	if err := ue.LoadModel(strings.NewReader(b.String())); err != nil {
+		t.Fatal(err)
+	}
+	a, err := sel.allPairs(ue, cui2vec.CosineMetric)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.QueryBlock, a.CandidateBlock = 4, 16
+	cuis, err := queries(ue, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matrix := func() *cui2vec.PrecomputedEmbeddings {
+		return &cui2vec.PrecomputedEmbeddings{
+			Cols:         sel.width(a.Len()) * cui2vec.EncodingFloat32.Stride(),
+			Encoding:     cui2vec.EncodingFloat32,
+			Metric:       cui2vec.CosineMetric.Name(),
+			Fingerprint:  ue.Fingerprint(),
+			Expected:     len(cuis),
+			VariableRows: true,
+		}
+	}
+	h := checkpointHeader{
+		Cols:     uint32(sel.width(a.Len()) * cui2vec.EncodingFloat32.Stride()),
+		Encoding: uint32(cui2vec.EncodingFloat32),
+		Metric:   cui2vec.CosineMetric.Name(),
+		Model:    ue.Fingerprint(),
+		Rows:     uint32(len(cuis)),
+		MinScore: sel.min,
+		Queries:  hashCUIs(cuis),
+	}
+	return a, cuis, matrix, h
+}
+
+func TestResume(t *testing.T) {
+	sel := selection{k: 5, min: 0.2}
+	a, cuis, matrix, h := setup(t, 200, sel)
+	dir, err := ioutil.TempDir("", "pcdvec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "distances.bin.checkpoint")
+
+	// An uninterrupted run.
+	var want bytes.Buffer
+	pe := matrix()
+	if err := distance(a, cuis, pe, sel, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := pe.WriteModel(&want); err != nil {
+		t.Fatal(err)
+	}
+
+	// A run that is interrupted after the first 60 rows, in the middle of writing another row.
+	const n = 60
+	ck, err := createCheckpoint(path, h, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := distance(a, cuis[:n], matrix(), sel, ck); err != nil {
+		t.Fatal(err)
+	}
+	cancel := make(chan struct{})
+	close(cancel)
+	a.Cancel = cancel
+	if err := distance(a, cuis[n:], matrix(), sel, ck); err != cui2vec.ErrCancelled {
+		t.Fatalf("expected the run to be cancelled, got %v", err)
+	}
+	a.Cancel = nil
+	ck.w.Write([]byte{1, 2, 3})
+	if err := ck.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A checkpoint is only resumed by the same run.
+	other := h
+	other.Queries = hashCUIs(cuis[1:])
+	if _, _, err := resumeCheckpoint(path, other, matrix(), time.Hour); err == nil {
+		t.Error("expected an error resuming the checkpoint of other cuis")
+	}
+	other = h
+	other.Model++
+	if _, _, err := resumeCheckpoint(path, other, matrix(), time.Hour); err == nil {
+		t.Error("expected an error resuming the checkpoint of another model")
+	}
+
+	pe = matrix()
+	ck, rows, err := resumeCheckpoint(path, h, pe, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != n {
+		t.Fatalf("expected %d rows in the checkpoint, got %d", n, rows)
+	}
+	todo := remaining(cuis, pe)
+	if len(todo) != len(cuis)-n {
+		t.Fatalf("expected %d cuis to remain, got %d", len(cuis)-n, len(todo))
+	}
+	if err := distance(a, todo, pe, sel, ck); err != nil {
+		t.Fatal(err)
+	}
+	if err := ck.close(); err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	if err := pe.WriteModel(&got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Error("the resumed run wrote a different file to the uninterrupted run")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hscells/cui2vec"
+	"gopkg.in/cheggaaa/pb.v1"
+	"hash/fnv"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// distance computes the neighbours of each of the cuis, or of every CUI if cuis is nil, into the rows of pe, keeping
+// those chosen by sel, and reports the throughput. Each row is recorded in the checkpoint, if there is one. When the
+// Cancel channel of a is closed, the rows that have been computed are kept and cui2vec.ErrCancelled is returned.
+func distance(a *cui2vec.AllPairs, cuis []string, pe *cui2vec.PrecomputedEmbeddings, sel selection, ck *checkpoint) error {
+	// Progress is written to stderr, as the model may be written to stdout.
+	defer fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "computing distances")
+
+	count := a.Len()
+	if cuis != nil {
+		count = len(cuis)
+	}
+	bar := pb.New(count)
+	bar.Output = os.Stderr
+	bar.Start()
+
+	start := time.Now()
+	rows := 0
+	err := a.Compute(cuis, func(neighbours cui2vec.Neighbours) error {
+		neighbours = sel.apply(neighbours)
+		if err := pe.SetNeighbours(neighbours); err != nil {
+			return err
+		}
+		if ck != nil {
+			c, err := cui2vec.CUI2Int(neighbours.CUI)
+			if err != nil {
+				return err
+			}
+			if err := ck.add(c, pe.Matrix[c]); err != nil {
+				return err
+			}
+		}
+		rows++
+		bar.Increment()
+		return nil
+	})
+	bar.Finish()
+
+	elapsed := time.Since(start).Seconds()
+	pairs := float64(rows) * float64(a.Len()-1)
+	fmt.Fprintf(os.Stderr, "computed %d cuis against %d cuis in %.1fs (%.0f cuis/s, %.1f million pairs/s)\n",
+		rows, a.Len(), elapsed, float64(rows)/elapsed, pairs/elapsed/1e6)
+	return err
+}
+
+// selection chooses which of the neighbours of a CUI are stored: at most k of them, or the number given for the CUI
+// in counts, that score at least min. A k <= 0 stores every neighbour of the CUIs without a count that scores at least
+// min.
+type selection struct {
+	k      int
+	counts map[string]int
+	min    float64
+}
+
+// newSelection chooses the given number of concepts, or 20 if none is given, that score at least the threshold, if
+// there is one. A threshold without a number of concepts chooses every concept that scores at least the threshold.
+func newSelection(concepts int, threshold *float64) selection {
+	s := selection{k: 20, min: math.Inf(-1)}
+	if threshold != nil {
+		s.min = *threshold
+		s.k = 0
+	}
+	if concepts > 0 {
+		s.k = concepts
+	}
+	return s
+}
+
+// allPairs prepares the neighbours of every CUI of ue to be computed under metric, holding in memory only the
+// neighbours that may be chosen.
+func (s selection) allPairs(ue *cui2vec.UncompressedEmbeddings, metric cui2vec.Metric) (*cui2vec.AllPairs, error) {
+	a, err := cui2vec.NewAllPairs(ue, metric, s.most())
+	if err != nil {
+		return nil, err
+	}
+	if !math.IsInf(s.min, -1) {
+		min := s.min
+		a.MinScore = &min
+	}
+	return a, nil
+}
+
+func (s selection) apply(n cui2vec.Neighbours) cui2vec.Neighbours {
+	k, ok := s.counts[n.CUI]
+	if !ok {
+		k = s.k
+	}
+	return n.Top(k).AtLeast(s.min)
+}
+
+// most is the most neighbours that are stored for any CUI, or zero if every neighbour may be stored.
+func (s selection) most() int {
+	if s.k <= 0 {
+		return 0
+	}
+	k := s.k
+	for _, c := range s.counts {
+		if c > k {
+			k = c
+		}
+	}
+	return k
+}
+
+// width is the most neighbours that are stored for any of n CUIs, each of which has at most n-1 neighbours.
+func (s selection) width(n int) int {
+	if k := s.most(); k > 0 {
+		return k
+	}
+	return n - 1
+}
+
+// loadCounts reads the number of neighbours to store for each CUI from a file of lines of a CUI and a count,
+// separated by a comma or whitespace. It also returns a hash of the file, which identifies the counts in a checkpoint.
+func loadCounts(path string) (map[string]int, uint64, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	counts := make(map[string]int)
+	for i, line := range strings.Split(string(b), "\n") {
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || unicode.IsSpace(r)
+		})
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, 0, fmt.Errorf("%s:%d: expected a cui and a count", path, i+1)
+		}
+		k, err := strconv.Atoi(fields[1])
+		if err != nil || k < 1 {
+			return nil, 0, fmt.Errorf("%s:%d: invalid count %q", path, i+1, fields[1])
+		}
+		counts[fields[0]] = k
+	}
+	h := fnv.New64a()
+	h.Write(b)
+	return counts, h.Sum64(), nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/hscells/cui2vec"
+	"testing"
+)
+
+func TestThreshold(t *testing.T) {
+	min := 0.3
+	sel := newSelection(0, &min)
+	a, cuis, matrix, _ := setup(t, 200, sel)
+	pe := matrix()
+	if err := distance(a, cuis, pe, sel, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without --concepts, every concept scoring at least the threshold is taken, which is far more than 20.
+	most := 0
+	for _, cui := range cuis {
+		concepts, err := pe.Similar(cui)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pe.Score = cui2vec.ScoreRaw
+		raw, err := pe.Similar(cui)
+		pe.Score = cui2vec.ScoreSoftmax
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range raw {
+			if c.Value < min {
+				t.Fatalf("%s has %s with a score of %f, below the threshold", cui, c.CUI, c.Value)
+			}
+		}
+		if len(concepts) > most {
+			most = len(concepts)
+		}
+	}
+	if most <= 20 {
+		t.Errorf("expected more than 20 concepts above the threshold, got at most %d", most)
+	}
+
+	// An explicit number of concepts is the most that are taken.
+	sel = newSelection(5, &min)
+	a, cuis, matrix, _ = setup(t, 200, sel)
+	pe = matrix()
+	if err := distance(a, cuis, pe, sel, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, cui := range cuis {
+		if concepts, err := pe.Similar(cui); err != nil {
+			t.Fatal(err)
+		} else if len(concepts) > 5 {
+			t.Fatalf("%s has %d concepts, expected at most 5", cui, len(concepts))
+		}
+	}
+}
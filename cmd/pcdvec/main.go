@@ -2,30 +2,37 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/alexflint/go-arg"
 	"github.com/hscells/cui2vec"
-	"gopkg.in/cheggaaa/pb.v1"
 	"io"
 	"io/ioutil"
-	"math"
 	"os"
-	"runtime"
-	"sort"
+	"os/signal"
 	"strings"
-	"sync"
-)
-
-const (
-	part = 10000000
+	"syscall"
+	"time"
 )
 
 type args struct {
-	CUI       string `arg:"required" help:"path to cui2vec model"`
-	Filter    string `arg:"-f" help:"only pre-compute these cuis"`
-	Output    string `arg:"-o" help:"where to output distances to (default stdout)"`
-	Concepts  int    `arg:"-n" help:"how many concepts to take (default 20)"`
-	SkipFirst bool   `help:"skip first line in cui2vec model?"`
+	CUI        string        `arg:"required" help:"path to cui2vec model"`
+	Filter     string        `arg:"-f" help:"only pre-compute these cuis"`
+	Output     string        `arg:"-o" help:"where to output distances to (default stdout)"`
+	Concepts   int           `arg:"-n" help:"how many concepts to take (default 20)"`
+	SkipFirst  bool          `help:"skip first line in cui2vec model?"`
+	Format     string        `help:"file format of the cui2vec model (auto/csv/word2vec) (default auto, or csv when --skipfirst is set)"`
+	Metric     string        `help:"similarity metric (cosine/dot/euclidean/manhattan/angular/pearson) (default cosine)"`
+	Encoding   string        `help:"how scores are stored (fixed/float32) (default float32)"`
+	Compress   string        `help:"compress the output (none/gzip/zstd) (default from the extension of --output)"`
+	Block      int           `help:"how many cuis each worker compares at once, which bounds memory (default 256)"`
+	Checkpoint string        `help:"where to record progress, so that an interrupted run can be resumed (default --output with .checkpoint appended)"`
+	Interval   time.Duration `help:"how often progress is flushed to the checkpoint (default 1m)"`
+	Resume     bool          `help:"resume from the checkpoint of an interrupted run"`
+	Shard      string        `help:"only compute the rows of shard i of n, written as i/n, for merging with pcdvec merge"`
+	Threshold  *float64      `help:"only take concepts scoring at least this under the metric, such as a minimum cosine similarity (default every such concept, or at most --concepts)"`
+	Counts     string        `help:"file of cui,k lines giving how many concepts to take for each of those cuis (default --concepts)"`
+	Variable   bool          `help:"store only the concepts of each row, rather than padding rows to the same length (default with --threshold or --counts)"`
 }
 
 func (args) Version() string {
@@ -33,157 +40,189 @@ func (args) Version() string {
 }
 
 func (args) Description() string {
-	return `pre-compute distances for cui2vec`
+	return `pre-compute distances for cui2vec
+
+modes:
+  pcdvec migrate --help    convert pre-computed distances to the float32 encoding
+  pcdvec merge --help      merge the shards of pre-computed distances
+  pcdvec verify --help     check the integrity of pre-computed distances`
 }
 
-func round(num float64) int {
-	return int(num + math.Copysign(0.5, num))
+// mustParse parses the arguments of a mode of pcdvec, exiting on errors or when help is requested.
+func mustParse(program string, dest interface{}, arguments []string) {
+	p, err := arg.NewParser(arg.Config{Program: program}, dest)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+	err = p.Parse(arguments)
+	if err == arg.ErrHelp {
+		p.WriteHelp(os.Stdout)
+		os.Exit(0)
+	}
+	if err == arg.ErrVersion {
+		fmt.Println(args{}.Version())
+		os.Exit(0)
+	}
+	if err != nil {
+		p.Fail(err.Error())
+	}
 }
 
-func distance(embeddings map[string][]float64, n int, filter []string) ([][]int, error) {
-	defer fmt.Println()
-	fmt.Println("computing distances")
-	var (
-		max    int
-		matrix [][]int
-	)
+// loadEmbeddings loads a cui2vec model in the given format.
+func loadEmbeddings(path, format string, skipFirst bool) (*cui2vec.UncompressedEmbeddings, error) {
+	input, err := os.OpenFile(path, os.O_RDONLY, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
 
-	// First, find the largest cui.
-	for cui := range embeddings {
-		c, err := cui2vec.CUI2Int(cui)
+	// The header row is only that of csv models, so giving --skipfirst skips detection.
+	if len(format) == 0 && skipFirst {
+		format = "csv"
+	}
+	switch format {
+	case "", "auto":
+		ue, f, err := cui2vec.LoadEmbeddings(input)
+		fmt.Fprintln(os.Stderr, "detected format", f)
+		return ue, err
+	case "csv":
+		return cui2vec.NewUncompressedEmbeddings(input, skipFirst, ',')
+	case "word2vec":
+		return cui2vec.NewWord2VecEmbeddings(input)
+	}
+	return nil, errors.New("unrecognised model format")
+}
+
+// createOutput opens path for writing, or stdout if path is empty. The output is compressed with the named
+// compression format, or the format implied by the extension of path if none is named.
+func createOutput(path, compress string) (io.WriteCloser, error) {
+	c := cui2vec.CompressionByExtension(path)
+	if len(compress) > 0 {
+		var err error
+		c, err = cui2vec.CompressionByName(compress)
 		if err != nil {
 			return nil, err
 		}
-		if c > max {
-			max = c
-		}
 	}
+	if len(path) == 0 {
+		return cui2vec.NewCompressedWriter(os.Stdout, c)
+	}
+	return cui2vec.CreateCompressed(path, c)
+}
 
-	fmt.Println("maximum size of sparse matrix:", max)
-
-	// Now, create a sparse matrix of size `max`.
-	matrix = make([][]int, max+1)
-
-	count := len(embeddings)
-	if len(filter) > 0 {
-		count = len(filter)
-	}
-	bar := pb.StartNew(count)
-
-	// Next, compute the distances between each cui and every other cui.
-	sem := make(chan bool, runtime.NumCPU())
-	for c1, e1 := range embeddings {
-		sem <- true
-		go func(concept string, emb []float64) {
-			defer func() { <-sem }()
-			if len(filter) > 0 {
-				found := false
-				for _, f := range filter {
-					if concept == f {
-						found = true
-						break
-					}
-				}
-				if found == false {
-					return
-				}
-			}
-
-			// Minus one because we don't include this cui.
-			concepts := make([]cui2vec.Concept, len(embeddings)-1)
-			i := 0
-
-			var wg sync.WaitGroup
-			for c2, e2 := range embeddings {
-				// Don't compute distances for the same cui.
-				if concept == c2 {
-					continue
-				}
-
-				if len(c2) == 0 {
-					continue
-				}
-				wg.Add(1)
-				go func(idx int, v1, v2 []float64, concept string) {
-					defer wg.Done()
-					sim, err := cui2vec.Cosine(v1, v2)
-					if err != nil {
-						panic(err)
-					}
-					concepts[idx] = cui2vec.Concept{
-						CUI:   concept,
-						Value: sim,
-					}
-				}(i, emb, e2, c2)
-				i++
-			}
-
-			wg.Wait()
-
-			// Normalise the concepts.
-			concepts = cui2vec.Softmax(concepts)
-
-			// Sort them by score.
-			sort.Slice(concepts, func(i, j int) bool {
-				return concepts[i].Value > concepts[j].Value
-			})
-
-			// Take the top n concepts (in this case n=20; hardcoded).
-			if len(concepts) < n {
-				n = len(concepts)
-			}
-			concepts = concepts[:n]
+// parseShard parses a shard written as i/n, where i is numbered from 1 to n. An empty shard is the whole matrix.
+func parseShard(s string) (int, int, error) {
+	if len(s) == 0 {
+		return 0, 0, nil
+	}
+	var shard, shards int
+	if _, err := fmt.Sscanf(s, "%d/%d", &shard, &shards); err != nil {
+		return 0, 0, fmt.Errorf("shard %q is not written as i/n", s)
+	}
+	if shards < 1 || shard < 1 || shard > shards {
+		return 0, 0, fmt.Errorf("invalid shard %d of %d", shard, shards)
+	}
+	return shard, shards, nil
+}
 
-			// Convert the string value of the cui into an int.
-			c, err := cui2vec.CUI2Int(concept)
+// queries returns the CUIs of the model whose rows are to be computed: those of the filter, or every CUI if there is
+// no filter, that are in the shard.
+func queries(ue *cui2vec.UncompressedEmbeddings, filter []string, shard, shards int) ([]string, error) {
+	cuis := filter
+	if cuis == nil {
+		for cui := range ue.Embeddings {
+			cuis = append(cuis, cui)
+		}
+	}
+	seen := make(map[string]bool)
+	q := make([]string, 0, len(cuis))
+	for _, cui := range cuis {
+		if _, ok := ue.Embeddings[cui]; !ok || seen[cui] {
+			continue
+		}
+		seen[cui] = true
+		if shards > 0 {
+			s, err := cui2vec.ShardOf(cui, shards)
 			if err != nil {
-				panic(err)
+				return nil, err
 			}
-
-			// Create the row for the current concept in the matrix.
-			matrix[c] = make([]int, len(concepts)*2)
-
-			// Insert the concepts one by one into the row.
-			for i, j := 0, 0; i < len(concepts); i++ {
-				cc, err := cui2vec.CUI2Int(concepts[i].CUI)
-				if err != nil {
-					panic(err)
-				}
-
-				v := int(round(concepts[i].Value * part))
-				v = v - v/part*part
-
-				matrix[c][j] = cc
-				matrix[c][j+1] = v
-				j += 2
+			if s != shard {
+				continue
 			}
-			bar.Increment()
-		}(c1, e1)
+		}
+		q = append(q, cui)
 	}
+	return q, nil
+}
 
-	// Wait until the last goroutine has read from the semaphore.
-	for i := 0; i < cap(sem); i++ {
-		sem <- true
+// remaining returns the CUIs whose rows are not in the matrix.
+func remaining(cuis []string, pe *cui2vec.PrecomputedEmbeddings) []string {
+	todo := make([]string, 0, len(cuis))
+	for _, cui := range cuis {
+		c, err := cui2vec.CUI2Int(cui)
+		if err != nil || c >= len(pe.Matrix) || pe.Matrix[c] == nil {
+			todo = append(todo, cui)
+		}
 	}
-
-	bar.Finish()
-
-	return matrix, nil
+	return todo
 }
 
 func main() {
 	var (
 		args   args
 		err    error
-		input  io.ReadCloser
 		output io.WriteCloser
 		filter []string
-		n      = 20
+		metric = cui2vec.CosineMetric
 	)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "merge" {
+		merge(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		verify(os.Args[2:])
+		return
+	}
 	arg.MustParse(&args)
 
-	if args.Concepts > 0 {
-		n = args.Concepts
+	if len(args.Metric) > 0 {
+		metric, err = cui2vec.MetricByName(args.Metric)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	encoding := cui2vec.EncodingFloat32
+	switch args.Encoding {
+	case "", "float32":
+	case "fixed":
+		encoding = cui2vec.EncodingFixedPoint
+	default:
+		panic(errors.New("unrecognised score encoding"))
+	}
+
+	shard, shards, err := parseShard(args.Shard)
+	if err != nil {
+		panic(err)
+	}
+
+	// Rows are only padded when every CUI is sure to have the same number of concepts.
+	sel := newSelection(args.Concepts, args.Threshold)
+	var counts uint64
+	if len(args.Counts) > 0 {
+		sel.counts, counts, err = loadCounts(args.Counts)
+		if err != nil {
+			panic(err)
+		}
+		args.Variable = true
+	}
+	if args.Threshold != nil {
+		args.Variable = true
 	}
 
 	if len(args.Filter) > 0 {
@@ -196,39 +235,104 @@ func main() {
 		}
 	}
 
-	// Open the output file, defaulting to stdout.
-	if len(args.Output) == 0 {
-		output = os.Stdout
-	} else {
-		output, err = os.OpenFile(args.Output, os.O_WRONLY|os.O_CREATE, os.ModePerm)
-		if err != nil {
-			panic(err)
-		}
+	// Load the embeddings into memory.
+	ue, err := loadEmbeddings(args.CUI, args.Format, args.SkipFirst)
+	if err != nil {
+		panic(err)
 	}
-	defer output.Close()
-
-	// Open the input file to read the embeddings.
-	input, err = os.OpenFile(args.CUI, os.O_RDONLY, os.ModePerm)
+	a, err := sel.allPairs(ue, metric)
 	if err != nil {
 		panic(err)
 	}
-	defer input.Close()
-
-	// Load the embeddings into memory.
-	ue, err := cui2vec.NewUncompressedEmbeddings(input, args.SkipFirst, ',')
+	a.QueryBlock = args.Block
+	cuis, err := queries(ue, filter, shard, shards)
 	if err != nil {
 		panic(err)
 	}
 
+	// Each concept is stored as a (cui, score) pair, or a (cui, raw score, softmax score) triple. The model and shard
+	// are recorded so that the shards of a run can be merged.
+	pe := &cui2vec.PrecomputedEmbeddings{
+		Cols:         sel.width(a.Len()) * encoding.Stride(),
+		Encoding:     encoding,
+		Metric:       metric.Name(),
+		Fingerprint:  ue.Fingerprint(),
+		Shard:        shard,
+		Shards:       shards,
+		Expected:     len(cuis),
+		VariableRows: args.Variable,
+	}
+
+	// Progress is recorded next to the output file, unless another checkpoint is given.
+	if len(args.Checkpoint) == 0 && len(args.Output) > 0 {
+		args.Checkpoint = args.Output + ".checkpoint"
+	}
+	if args.Interval <= 0 {
+		args.Interval = time.Minute
+	}
+	var ck *checkpoint
+	if len(args.Checkpoint) > 0 {
+		h := checkpointHeader{
+			Cols:     uint32(pe.Cols),
+			Encoding: uint32(encoding),
+			Metric:   metric.Name(),
+			Model:    pe.Fingerprint,
+			Shard:    uint32(shard),
+			Shards:   uint32(shards),
+			Rows:     uint32(len(cuis)),
+			MinScore: sel.min,
+			Counts:   counts,
+			Queries:  hashCUIs(cuis),
+		}
+		if args.Resume {
+			var rows int
+			ck, rows, err = resumeCheckpoint(args.Checkpoint, h, pe, args.Interval)
+			if err != nil {
+				panic(err)
+			}
+			fmt.Fprintf(os.Stderr, "resuming from %d cuis in %s\n", rows, args.Checkpoint)
+			cuis = remaining(cuis, pe)
+		} else {
+			ck, err = createCheckpoint(args.Checkpoint, h, args.Interval)
+			if err != nil {
+				panic(err)
+			}
+		}
+	} else if args.Resume {
+		panic(errors.New("--resume requires --output or --checkpoint"))
+	}
+
+	// An interrupted run flushes its progress to the checkpoint, so that it can be resumed. Only the first signal is
+	// caught, so that a second one stops pcdvec at once.
+	if ck != nil {
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+		cancel := make(chan struct{})
+		go func() {
+			<-interrupt
+			signal.Stop(interrupt)
+			close(cancel)
+		}()
+		a.Cancel = cancel
+	}
+
 	// Create a new pre-computed embeddings with distance calculations.
-	m, err := distance(ue.Embeddings, n, filter)
+	err = distance(a, cuis, pe, sel, ck)
+	if err == cui2vec.ErrCancelled {
+		if err := ck.close(); err != nil {
+			panic(err)
+		}
+		fmt.Fprintf(os.Stderr, "interrupted, progress was saved to %s; run again with --resume to continue\n", args.Checkpoint)
+		os.Exit(130)
+	}
 	if err != nil {
 		panic(err)
 	}
 
-	pe := cui2vec.PrecomputedEmbeddings{
-		Matrix: m,
-		Cols:   n,
+	// Open the output file, defaulting to stdout.
+	output, err = createOutput(args.Output, args.Compress)
+	if err != nil {
+		panic(err)
 	}
 
 	// Output the pre-computed distances to file.
@@ -236,6 +340,20 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	err = output.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	// The checkpoint is no longer needed once the output is complete.
+	if ck != nil {
+		if err := ck.close(); err != nil {
+			panic(err)
+		}
+		if err := os.Remove(args.Checkpoint); err != nil {
+			panic(err)
+		}
+	}
 
 	return
 }
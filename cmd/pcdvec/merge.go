@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hscells/cui2vec"
+	"os"
+)
+
+type mergeArgs struct {
+	Output   string   `arg:"-o,required" help:"where to output the merged distances to"`
+	Compress string   `help:"compress the output (none/gzip/zstd) (default from the extension of --output)"`
+	Inputs   []string `arg:"positional,required" help:"the shards of pre-computed distances to merge"`
+}
+
+func (mergeArgs) Version() string {
+	return args{}.Version()
+}
+
+func (mergeArgs) Description() string {
+	return `merge the shards of pre-computed distances computed with pcdvec --shard`
+}
+
+// merge combines the shards of pre-computed distances into one file.
+func merge(arguments []string) {
+	var args mergeArgs
+	mustParse("pcdvec merge", &args, arguments)
+
+	shards := make([]*cui2vec.PrecomputedEmbeddings, len(args.Inputs))
+	for i, path := range args.Inputs {
+		input, err := os.OpenFile(path, os.O_RDONLY, os.ModePerm)
+		if err != nil {
+			panic(err)
+		}
+		shards[i], err = cui2vec.NewPrecomputedEmbeddings(input)
+		input.Close()
+		if err != nil {
+			panic(fmt.Errorf("%s: %w", path, err))
+		}
+		fmt.Printf("loaded shard %d/%d with %d rows from %s\n", shards[i].Shard, shards[i].Shards, shards[i].Expected, path)
+	}
+
+	pe, err := cui2vec.MergePrecomputed(shards...)
+	if err != nil {
+		panic(err)
+	}
+
+	output, err := createOutput(args.Output, args.Compress)
+	if err != nil {
+		panic(err)
+	}
+	if err := pe.WriteModel(output); err != nil {
+		panic(err)
+	}
+	if err := output.Close(); err != nil {
+		panic(err)
+	}
+	fmt.Printf("merged %d rows into %s\n", pe.Expected, args.Output)
+}
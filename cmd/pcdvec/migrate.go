@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hscells/cui2vec"
+	"os"
+)
+
+type migrateArgs struct {
+	Input     string `arg:"required" help:"path to pre-computed distances to migrate"`
+	Output    string `arg:"-o,required" help:"where to output the migrated distances to"`
+	Model     string `help:"path to the cui2vec model, used to recompute raw scores"`
+	Format    string `help:"file format of the cui2vec model (auto/csv/word2vec) (default auto)"`
+	SkipFirst bool   `help:"skip first line in cui2vec model?"`
+	Cols      int    `help:"number of columns in legacy files without a header (default 20)"`
+	Compress  string `help:"compress the output (none/gzip/zstd) (default from the extension of --output)"`
+}
+
+func (migrateArgs) Version() string {
+	return args{}.Version()
+}
+
+func (migrateArgs) Description() string {
+	return `convert pre-computed distances to the lossless float32 encoding`
+}
+
+// migrate converts pre-computed distances to the float32 encoding.
+func migrate(arguments []string) {
+	var args migrateArgs
+	mustParse("pcdvec migrate", &args, arguments)
+
+	input, err := os.OpenFile(args.Input, os.O_RDONLY, os.ModePerm)
+	if err != nil {
+		panic(err)
+	}
+	defer input.Close()
+	// The number of columns is only used when the file has no header.
+	pe := &cui2vec.PrecomputedEmbeddings{Cols: 20}
+	if args.Cols > 0 {
+		pe.Cols = args.Cols
+	}
+	dr, err := cui2vec.Decompress(input)
+	if err != nil {
+		panic(err)
+	}
+	defer dr.Close()
+	if err := pe.LoadModel(dr); err != nil {
+		panic(err)
+	}
+	fmt.Printf("loaded %s distances with %d columns\n", pe.Encoding, pe.Cols)
+
+	var ue *cui2vec.UncompressedEmbeddings
+	if len(args.Model) > 0 {
+		ue, err = loadEmbeddings(args.Model, args.Format, args.SkipFirst)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if err := pe.Migrate(ue); err != nil {
+		panic(err)
+	}
+
+	output, err := createOutput(args.Output, args.Compress)
+	if err != nil {
+		panic(err)
+	}
+	if err := pe.WriteModel(output); err != nil {
+		panic(err)
+	}
+	if err := output.Close(); err != nil {
+		panic(err)
+	}
+}
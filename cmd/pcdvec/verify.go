@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hscells/cui2vec"
+	"os"
+)
+
+type verifyArgs struct {
+	Examples int      `help:"how many problems to describe for each file (default 10)"`
+	Cols     int      `help:"number of columns in legacy files without a header (default 20)"`
+	Inputs   []string `arg:"positional,required" help:"the pre-computed distances to verify"`
+}
+
+func (verifyArgs) Version() string {
+	return args{}.Version()
+}
+
+func (verifyArgs) Description() string {
+	return `check the integrity of pre-computed distances, exiting with a non-zero status if any are corrupt`
+}
+
+// verify inspects each file of pre-computed distances, and exits with status 1 if any of them are corrupt.
+func verify(arguments []string) {
+	var args verifyArgs
+	mustParse("pcdvec verify", &args, arguments)
+	if args.Examples <= 0 {
+		args.Examples = 10
+	}
+
+	corrupt := false
+	for _, path := range args.Inputs {
+		if ok := verifyFile(path, args.Cols, args.Examples); !ok {
+			corrupt = true
+		}
+	}
+	if corrupt {
+		os.Exit(1)
+	}
+}
+
+// verifyFile reports on the pre-computed distances at path, and whether they were read without any problems.
+func verifyFile(path string, cols, examples int) bool {
+	pe := &cui2vec.PrecomputedEmbeddings{Cols: 20}
+	if cols > 0 {
+		pe.Cols = cols
+	}
+	err := func() error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		dr, err := cui2vec.Decompress(f)
+		if err != nil {
+			return err
+		}
+		defer dr.Close()
+		return pe.LoadModel(dr)
+	}()
+	if err != nil {
+		fmt.Printf("%s: %v\n  corrupt\n", path, err)
+		return false
+	}
+
+	in := pe.Inspect(examples)
+	metric := pe.Metric
+	if len(metric) == 0 {
+		metric = "unknown"
+	}
+	fmt.Printf("%s: %d rows, %d populated (%d without neighbours), %d columns of %s %s scores\n",
+		path, in.Rows, in.Populated, in.Empty, pe.Cols, pe.Encoding, metric)
+	fmt.Printf("  %d neighbours, %d rows padded with zeros\n", in.Neighbours, in.Padded)
+	if pe.Fingerprint != 0 {
+		fmt.Printf("  computed from model %016x", pe.Fingerprint)
+		if pe.Shards > 0 {
+			fmt.Printf(" as shard %d/%d", pe.Shard, pe.Shards)
+		}
+		fmt.Printf(", %d rows expected\n", pe.Expected)
+	}
+	for _, p := range in.Kinds() {
+		fmt.Printf("  %d %s\n", in.Problems[p], p)
+	}
+	for _, e := range in.Examples {
+		fmt.Printf("    %s\n", e)
+	}
+	if in.Corrupt() {
+		fmt.Println("  corrupt")
+		return false
+	}
+	fmt.Println("  ok")
+	return true
+}
@@ -1,19 +1,27 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/alexflint/go-arg"
 	"github.com/hscells/cui2vec"
 	"net"
 	"net/rpc"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
 type args struct {
-	CUI       string `arg:"required" help:"path to uncompressed model"`
-	Delimiter rune   `help:"What is the delimiter (default:' ')"`
+	CUI       string `arg:"required" help:"path to uncompressed or binary model, or comma-separated paths of models to merge"`
+	Delimiter rune   `help:"What is the delimiter of csv models (default: ' ')"`
 	SkipFirst bool   `help:"skip first line in cui2vec model?"`
+	Format    string `help:"file format of the model (auto/csv/word2vec/binary/npy) (default auto, or csv when --delimiter or --skipfirst is set)"`
+	Vocab     string `help:"path to the vocabulary of an npy model (default the model path with .vocab appended)"`
+	Merge     string `help:"how to merge models given as comma-separated paths (first/average/concatenate) (default first)"`
+	NumCUIS   int    `arg:"-n" help:"number of similar cuis to respond with (default all)"`
+	Raw       bool   `help:"respond with the raw scores of the metric rather than their softmax"`
 }
 
 func (args) Version() string {
@@ -26,9 +34,22 @@ func (args) Description() string {
 
 type similarCache map[string][]cui2vec.Concept
 
+// vectorEmbeddings are embeddings that can look up the vector of a CUI, such as cui2vec.MappedEmbeddings.
+type vectorEmbeddings interface {
+	Vector(cui string) ([]float64, bool)
+}
+
+// softmaxEmbeddings are embeddings that can normalise the scores of the k most similar CUIs with softmax.
+type softmaxEmbeddings interface {
+	SimilarKSoftmax(cui string, k int) ([]cui2vec.Concept, error)
+}
+
 type EmbeddingsRPC struct {
-	embeddings *cui2vec.UncompressedEmbeddings
+	embeddings cui2vec.KEmbeddings
 	cache      similarCache
+	mu         sync.RWMutex
+	k          int
+	raw        bool
 }
 
 func logf(message string, args ...interface{}) {
@@ -36,7 +57,15 @@ func logf(message string, args ...interface{}) {
 }
 
 func (e *EmbeddingsRPC) GetVector(cui string, vec *cui2vec.VecResponse) error {
-	if v, ok := e.embeddings.Embeddings[cui]; ok {
+	var v []float64
+	var ok bool
+	switch embeddings := e.embeddings.(type) {
+	case *cui2vec.UncompressedEmbeddings:
+		v, ok = embeddings.Embeddings[cui]
+	case vectorEmbeddings:
+		v, ok = embeddings.Vector(cui)
+	}
+	if ok {
 		vec.V = v
 		logf("request for %s, found: %d", cui, len(vec.V))
 		return nil
@@ -46,19 +75,110 @@ func (e *EmbeddingsRPC) GetVector(cui string, vec *cui2vec.VecResponse) error {
 }
 
 func (e *EmbeddingsRPC) GetSimilar(cui string, vec *cui2vec.SimResponse) error {
-	if v, ok := e.cache[cui]; ok {
+	e.mu.RLock()
+	v, ok := e.cache[cui]
+	e.mu.RUnlock()
+	if ok {
 		vec.V = v
 		return nil
 	}
 	logf("request for %s", cui)
-	v, err := e.embeddings.Similar(cui)
-	if err != nil {
+	var err error
+	if se, ok := e.embeddings.(softmaxEmbeddings); ok && !e.raw {
+		v, err = se.SimilarKSoftmax(cui, e.k)
+	} else {
+		v, err = e.embeddings.SimilarK(cui, e.k)
+	}
+	if err == nil {
+		e.mu.Lock()
 		e.cache[cui] = v
+		e.mu.Unlock()
+	}
+	vec.V = v
+	return err
+}
+
+func (e *EmbeddingsRPC) GetAnalogy(req cui2vec.AnalogyRequest, vec *cui2vec.SimResponse) error {
+	logf("analogy request for %s:%s::%s:?", req.A, req.B, req.C)
+	ue, ok := e.embeddings.(*cui2vec.UncompressedEmbeddings)
+	if !ok {
+		return errors.New("analogies require an uncompressed model")
 	}
+	v, err := ue.AnalogyWith(req.A, req.B, req.C, req.K, req.Method)
 	vec.V = v
 	return err
 }
 
+// loadEmbeddings loads the model given in the arguments. Several models given as comma-separated paths, or every
+// shard of a sharded model, are merged.
+func loadEmbeddings(args args) (cui2vec.KEmbeddings, error) {
+	paths := strings.Split(args.CUI, ",")
+	_, sharded, err := cui2vec.ShardPaths(args.CUI)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) > 1 || sharded {
+		if (len(args.Format) > 0 && args.Format != "auto") || args.SkipFirst || args.Delimiter != 0 {
+			return nil, errors.New("the format of merged models is always detected, so --format, --skipfirst and --delimiter cannot be given")
+		}
+		policy := cui2vec.PreferFirst
+		if len(args.Merge) > 0 {
+			policy, err = cui2vec.MergePolicyByName(args.Merge)
+			if err != nil {
+				return nil, err
+			}
+		}
+		m, err := cui2vec.MergeFiles(policy, paths...)
+		if err != nil {
+			return nil, err
+		}
+		logf("merged %d cuis with the %s policy", len(m.Embeddings), policy)
+		// The merged vectors are served as any other uncompressed model.
+		return m.UncompressedEmbeddings, nil
+	}
+
+	// Binary models are memory-mapped, which opens the file itself.
+	if args.Format == "binary" {
+		return cui2vec.OpenMappedEmbeddings(args.CUI)
+	}
+
+	f, err := os.OpenFile(args.CUI, os.O_RDONLY, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// The delimiter and header row are only those of csv models, so giving either skips detection.
+	if len(args.Format) == 0 && (args.Delimiter != 0 || args.SkipFirst) {
+		args.Format = "csv"
+	}
+	if args.Delimiter == 0 {
+		args.Delimiter = ' '
+	}
+
+	switch args.Format {
+	case "", "auto":
+		e, format, err := cui2vec.LoadEmbeddings(f)
+		logf("detected format %s", format)
+		return e, err
+	case "csv":
+		return cui2vec.NewUncompressedEmbeddings(f, args.SkipFirst, args.Delimiter)
+	case "word2vec":
+		return cui2vec.NewWord2VecEmbeddings(f)
+	case "npy":
+		if len(args.Vocab) == 0 {
+			args.Vocab = args.CUI + ".vocab"
+		}
+		vocab, err := os.Open(args.Vocab)
+		if err != nil {
+			return nil, err
+		}
+		defer vocab.Close()
+		return cui2vec.NewNumPyEmbeddings(f, vocab)
+	}
+	return nil, errors.New("unrecognised model format")
+}
+
 func main() {
 	var args args
 	arg.MustParse(&args)
@@ -75,26 +195,13 @@ func main() {
 	}
 
 	logf("loading embeddings...")
-	f, err := os.OpenFile(args.CUI, os.O_RDONLY, os.ModePerm)
-	if err != nil {
-		panic(err)
-	}
-
-	if args.Delimiter == 0 {
-		args.Delimiter = ' '
-	}
-
-	e, err := cui2vec.NewUncompressedEmbeddings(f, args.SkipFirst, args.Delimiter)
+	e, err := loadEmbeddings(args)
 	if err != nil {
 		panic(err)
 	}
 
-	fmt.Println(e.Embeddings["C0243032"])
-
 	logf("registering listener...")
-	listener := new(EmbeddingsRPC)
-	x := EmbeddingsRPC{embeddings: e, cache: make(similarCache)}
-	listener = &x
+	listener := &EmbeddingsRPC{embeddings: e, cache: make(similarCache), k: args.NumCUIS, raw: args.Raw}
 	err = rpc.Register(listener)
 	if err != nil {
 		panic(err)
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hscells/cui2vec"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMergedModel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vecserver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	models := []string{
+		"3 2\nC0000001 1 0\nC0000002 0 1\nC0000003 1 1\n",
+		"3 2\nC0000003 -1 -1\nC0000004 1 -1\nC0000005 -1 1\n",
+	}
+	var paths []string
+	for i, model := range models {
+		path := filepath.Join(dir, fmt.Sprintf("model-%d.vec", i))
+		if err := ioutil.WriteFile(path, []byte(model), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	e, err := loadEmbeddings(args{CUI: paths[0] + "," + paths[1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := rpc.NewServer()
+	if err := server.Register(&EmbeddingsRPC{embeddings: e, cache: make(similarCache)}); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go server.Accept(l)
+
+	client, err := cui2vec.NewVecClient(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cui := range []string{"C0000001", "C0000005"} {
+		vec, err := client.Vec(cui)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(vec) != 2 {
+			t.Errorf("expected a vector of 2 dimensions for %s, got %v", cui, vec)
+		}
+	}
+	concepts, err := client.Sim("C0000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(concepts) != 4 {
+		t.Errorf("expected 4 similar cuis, got %v", concepts)
+	}
+	// Scores are normalised with softmax over every CUI unless raw scores are asked for.
+	sum := 0.0
+	for _, c := range concepts {
+		sum += c.Value
+	}
+	if math.Abs(sum-1) > 1e-9 {
+		t.Errorf("expected softmax scores that sum to 1, got %v", concepts)
+	}
+	concepts, err = client.Analogy("C0000001", "C0000002", "C0000004", 1, cui2vec.ThreeCosAdd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(concepts) != 1 {
+		t.Errorf("expected an answer to the analogy, got %v", concepts)
+	}
+}
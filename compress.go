@@ -0,0 +1,177 @@
+package cui2vec
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Compression is a compression format that models and mappings may be stored in.
+type Compression int
+
+const (
+	// NoCompression is an uncompressed file.
+	NoCompression Compression = iota
+	// Gzip is a gzip compressed file.
+	Gzip
+	// Bzip2 is a bzip2 compressed file. Bzip2 files can be read but not written.
+	Bzip2
+	// Zstd is a Zstandard compressed file.
+	Zstd
+)
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case Gzip:
+		return "gzip"
+	case Bzip2:
+		return "bzip2"
+	case Zstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+// CompressionByName returns the compression format with the given name (none/gzip/bzip2/zstd).
+func CompressionByName(name string) (Compression, error) {
+	for _, c := range []Compression{NoCompression, Gzip, Bzip2, Zstd} {
+		if c.String() == strings.ToLower(name) {
+			return c, nil
+		}
+	}
+	return NoCompression, fmt.Errorf("unrecognised compression %q", name)
+}
+
+// CompressionByExtension guesses the compression format of a file from its extension (.gz/.bz2/.zst).
+func CompressionByExtension(path string) Compression {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gz", ".gzip":
+		return Gzip
+	case ".bz2":
+		return Bzip2
+	case ".zst", ".zstd":
+		return Zstd
+	}
+	return NoCompression
+}
+
+// DetectCompression determines the compression format of a file from its magic bytes, without consuming any of it.
+func DetectCompression(br *bufio.Reader) (Compression, error) {
+	b, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return NoCompression, err
+	}
+	switch {
+	case bytes.HasPrefix(b, gzipMagic):
+		return Gzip, nil
+	case bytes.HasPrefix(b, bzip2Magic):
+		return Bzip2, nil
+	case bytes.HasPrefix(b, zstdMagic):
+		return Zstd, nil
+	}
+	return NoCompression, nil
+}
+
+// Decompress returns a reader that transparently decompresses r if it is compressed with any of the supported
+// formats. Closing the reader releases the decompressor, but does not close r.
+func Decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	c, err := DetectCompression(br)
+	if err != nil {
+		return nil, err
+	}
+	switch c {
+	case Gzip:
+		return gzip.NewReader(br)
+	case Bzip2:
+		return ioutil.NopCloser(bzip2.NewReader(br)), nil
+	case Zstd:
+		d, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return ioutil.NopCloser(br), nil
+}
+
+// NewCompressedWriter returns a writer that compresses what is written to w with the given compression format.
+// The writer must be closed to flush the compressed data, which does not close w.
+func NewCompressedWriter(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case NoCompression:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	case Bzip2:
+		return nil, errors.New("bzip2 compression is not supported for writing")
+	}
+	return nil, fmt.Errorf("unrecognised compression %d", int(c))
+}
+
+// CreateCompressed creates or truncates the file at path, and returns a writer that compresses what is written to
+// it with the given compression format. Closing the writer flushes the compressed data and closes the file.
+func CreateCompressed(path string, c Compression) (io.WriteCloser, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w, err := NewCompressedWriter(f, c)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return compressedFile{WriteCloser: w, f: f}, nil
+}
+
+// compressedFile closes a compressed writer and then the file it writes to.
+type compressedFile struct {
+	io.WriteCloser
+	f *os.File
+}
+
+func (c compressedFile) Close() error {
+	err := c.WriteCloser.Close()
+	if cerr := c.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// nopWriteCloser is a writer with a Close method that does nothing.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// decompressed calls fn with a reader that transparently decompresses r.
+func decompressed(r io.Reader, fn func(r io.Reader) error) error {
+	dr, err := Decompress(r)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	return fn(dr)
+}
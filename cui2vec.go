@@ -15,6 +15,12 @@ type Embeddings interface {
 	Similar(cui string) ([]Concept, error)
 }
 
+// KEmbeddings are Embeddings that can compute only the k most similar CUIs to a target CUI.
+type KEmbeddings interface {
+	Embeddings
+	SimilarK(cui string, k int) ([]Concept, error)
+}
+
 // Concept is a CUI that has a similarity score in relation to a target CUI.
 type Concept struct {
 	CUI   string
@@ -45,20 +51,32 @@ func Int2CUI(val int) string {
 	return "C" + cui
 }
 
+// NewUncompressedEmbeddings loads a cui2vec model from a delimited file, which may be compressed with any format
+// recognised by Decompress. When comma is zero, the format of the file is detected with DetectFormat and skipFirst
+// is ignored.
 func NewUncompressedEmbeddings(r io.Reader, skipFirst bool, comma rune) (*UncompressedEmbeddings, error) {
 	v := &UncompressedEmbeddings{
 		SkipFirst:  skipFirst,
 		Embeddings: make(map[string][]float64),
 	}
+	if comma == 0 {
+		err := decompressed(r, func(r io.Reader) error {
+			_, err := v.LoadDetected(r)
+			return err
+		})
+		return v, err
+	}
 	v.Comma = comma
-	err := v.LoadModel(r)
+	err := decompressed(r, v.LoadModel)
 	return v, err
 }
 
+// NewPrecomputedEmbeddings loads a pre-computed distances file, decompressing it if necessary. The shape of the
+// matrix is read from the header of the file, or assumed to be 20 columns wide for legacy files without a header.
 func NewPrecomputedEmbeddings(r io.Reader) (*PrecomputedEmbeddings, error) {
 	v := &PrecomputedEmbeddings{
 		Cols: 20,
 	}
-	err := v.LoadModel(r)
+	err := decompressed(r, v.LoadModel)
 	return v, err
 }
@@ -1,9 +1,19 @@
 package cui2vec_test
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/hscells/cui2vec"
+	"hash/crc32"
+	"io/ioutil"
+	"math"
+	"math/rand"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -15,7 +25,7 @@ func TestUncompressed(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	v, err := cui2vec.NewUncompressedEmbeddings(f, true)
+	v, err := cui2vec.NewUncompressedEmbeddings(f, true, ',')
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -53,7 +63,7 @@ func BenchmarkUncompressed(b *testing.B) {
 		b.Fatal(err)
 	}
 
-	v, err := cui2vec.NewUncompressedEmbeddings(f, true)
+	v, err := cui2vec.NewUncompressedEmbeddings(f, true, ',')
 	if err != nil {
 		b.Fatal(err)
 	}
@@ -62,6 +72,22 @@ func BenchmarkUncompressed(b *testing.B) {
 	}
 }
 
+func BenchmarkUncompressedNormalised(b *testing.B) {
+	f, err := os.Open("cui2vec_pretrained.csv")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	v := &cui2vec.UncompressedEmbeddings{SkipFirst: true, Comma: ',', Normalise: true, Storage: cui2vec.DenseStorage}
+	err = v.LoadModel(f)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, c := range cuis {
+		v.SimilarK(c, 20)
+	}
+}
+
 func BenchmarkPrecomputed(b *testing.B) {
 	f, err := os.Open("cui2vec_precomputed.bin")
 	if err != nil {
@@ -76,3 +102,1369 @@ func BenchmarkPrecomputed(b *testing.B) {
 		v.Similar(c)
 	}
 }
+
+func TestUncompressedLoadPolicy(t *testing.T) {
+	model := "C0000001,0.1,0.2\nC0000002,0.3,x\n\nC0000003,0.5,0.6\nC0000004,\"0.7,0.8\n"
+
+	_, err := cui2vec.NewUncompressedEmbeddings(strings.NewReader(model), false, ',')
+	lineErr, ok := err.(*cui2vec.LineError)
+	if !ok {
+		t.Fatalf("expected a *LineError, got %v", err)
+	}
+	if lineErr.Line != 2 {
+		t.Fatalf("expected the first invalid line, got line %d", lineErr.Line)
+	}
+
+	v := &cui2vec.UncompressedEmbeddings{Comma: ',', Policy: cui2vec.SkipInvalid}
+	if err := v.LoadModel(strings.NewReader(model)); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Embeddings) != 2 || v.Report.Loaded != 2 || len(v.Report.Skipped) != 2 {
+		t.Fatalf("unexpected report %+v", v.Report)
+	}
+	if e := v.Report.Skipped[0]; e.Line != 2 || e.Column != 3 {
+		t.Fatalf("unexpected skipped line %v", e)
+	}
+
+	for n, line := range map[int]int{1: 2, 2: 5, 3: 0} {
+		v = &cui2vec.UncompressedEmbeddings{Comma: ',', Policy: cui2vec.StopAfterN, MaxErrors: n}
+		err := v.LoadModel(strings.NewReader(model))
+		if line == 0 {
+			if err != nil {
+				t.Errorf("expected no error with at most %d invalid lines, got %v", n, err)
+			}
+			continue
+		}
+		if lineErr, ok := err.(*cui2vec.LineError); !ok || lineErr.Line != line {
+			t.Errorf("expected an error at line %d after %d invalid lines, got %v", line, n, err)
+		}
+		if len(v.Report.Skipped) != n {
+			t.Errorf("expected %d skipped lines, got %d", n, len(v.Report.Skipped))
+		}
+	}
+}
+
+// syntheticModel creates a cui2vec csv model of n random vectors with the given dimensions.
+func syntheticModel(n, dims int) string {
+	rng := rand.New(rand.NewSource(1))
+	var b strings.Builder
+	for i := 1; i <= n; i++ {
+		b.WriteString(cui2vec.Int2CUI(i))
+		for j := 0; j < dims; j++ {
+			b.WriteString(fmt.Sprintf(",%f", rng.NormFloat64()))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// loadValues loads a csv model without the zero in place of the CUI column, so that its vectors hold only the values
+// of the model, as they do when loaded from any other format.
+func loadValues(t testing.TB, model string) *cui2vec.UncompressedEmbeddings {
+	v := &cui2vec.UncompressedEmbeddings{Comma: ',', DropCUIColumn: true}
+	if err := v.LoadModel(strings.NewReader(model)); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestUncompressedSimilarK(t *testing.T) {
+	v, err := cui2vec.NewUncompressedEmbeddings(strings.NewReader(syntheticModel(500, 16)), false, ',')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := v.Similar("C0000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 499 {
+		t.Fatalf("expected 499 concepts, got %d", len(all))
+	}
+
+	top, err := v.SimilarKSoftmax("C0000001", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := v.SimilarK("C0000001", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range top {
+		if top[i].CUI != all[i].CUI || math.Abs(top[i].Value-all[i].Value) > 1e-12 {
+			t.Fatalf("softmax concept %d differs: %v != %v", i, top[i], all[i])
+		}
+		if raw[i].CUI != all[i].CUI {
+			t.Fatalf("raw concept %d differs: %v != %v", i, raw[i], all[i])
+		}
+		if i > 0 && raw[i].Value > raw[i-1].Value {
+			t.Fatalf("concepts are not sorted: %v", raw)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	x, y := []float64{1, 0, 1}, []float64{0, 1, 1}
+	expected := map[string]float64{
+		"cosine":    0.5,
+		"dot":       1,
+		"euclidean": -math.Sqrt2,
+		"manhattan": -2,
+		"angular":   -1.0 / 3.0,
+		"pearson":   -0.5,
+	}
+	for name, want := range expected {
+		m, err := cui2vec.MetricByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := m.Similarity(x, y)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(got-want) > 1e-9 {
+			t.Errorf("%s: expected %f, got %f", name, want, got)
+		}
+	}
+	if _, err := cui2vec.MetricByName("hamming"); err == nil {
+		t.Error("expected an error for an unknown metric")
+	}
+
+	// The zero in place of the CUI column of a model loaded into the map is not scored, so Pearson correlation is
+	// the same as for x and y.
+	v, err := cui2vec.NewUncompressedEmbeddings(strings.NewReader("C0000001,1,0,1\nC0000002,0,1,1\n"), false, ',')
+	if err != nil {
+		t.Fatal(err)
+	}
+	concepts, err := v.SimilarMetric("C0000001", 1, cui2vec.PearsonMetric)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(concepts) != 1 || math.Abs(concepts[0].Value+0.5) > 1e-9 {
+		t.Errorf("expected a pearson correlation of -0.5, got %v", concepts)
+	}
+	a, err := cui2vec.NewAllPairs(v, cui2vec.PearsonMetric, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.Compute([]string{"C0000001"}, func(n cui2vec.Neighbours) error {
+		if len(n.Concepts) != 1 || math.Abs(n.Concepts[0].Value+0.5) > 1e-9 {
+			t.Errorf("expected all pairs to have a pearson correlation of -0.5, got %v", n.Concepts)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUncompressedAnalogy(t *testing.T) {
+	model := "C0000001,1,0,0\nC0000002,1,1,0\nC0000003,0,0,1\nC0000004,0,1,1\nC0000005,0,-1,1\n"
+	v, err := cui2vec.NewUncompressedEmbeddings(strings.NewReader(model), false, ',')
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []cui2vec.AnalogyMethod{cui2vec.ThreeCosAdd, cui2vec.ThreeCosMul} {
+		concepts, err := v.AnalogyWith("C0000001", "C0000002", "C0000003", 2, method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(concepts) != 2 || concepts[0].CUI != "C0000004" {
+			t.Errorf("%s: unexpected analogy %v", method, concepts)
+		}
+	}
+	if _, err := v.Analogy("C0000001", "C0000002", "C0000009", 2); err == nil {
+		t.Error("expected an error for a missing cui")
+	}
+}
+
+func TestSimilarSet(t *testing.T) {
+	model := "C0000001,1,0,0\nC0000002,0,1,0\nC0000003,1,1,0\nC0000004,1,-1,0\nC0000005,0,0,1\n"
+	v, err := cui2vec.NewUncompressedEmbeddings(strings.NewReader(model), false, ',')
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := []cui2vec.WeightedCUI{{CUI: "C0000001", Weight: 1}, {CUI: "C0000002", Weight: -1}}
+	for _, strategy := range []cui2vec.FusionStrategy{cui2vec.Centroid, cui2vec.ScoreFusion} {
+		concepts, err := v.SimilarSet(query, 0, strategy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(concepts) != 3 || concepts[0].CUI != "C0000004" {
+			t.Errorf("strategy %d: unexpected concepts %v", strategy, concepts)
+		}
+	}
+
+	p := &cui2vec.PrecomputedEmbeddings{
+		Cols: 4,
+		Matrix: [][]int{
+			1: {3, 5000000, 4, 2000000},
+			2: {3, 4000000, 5, 3000000},
+		},
+	}
+	results, err := p.SimilarSets([][]cui2vec.WeightedCUI{query, {{CUI: "C0000002", Weight: 1}}}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0][0].CUI != "C0000004" || results[1][0].CUI != "C0000003" {
+		t.Errorf("unexpected fused concepts %v", results)
+	}
+}
+
+func TestUncompressedDenseStorage(t *testing.T) {
+	model := syntheticModel(300, 8)
+	m, err := cui2vec.NewUncompressedEmbeddings(strings.NewReader(model), false, ',')
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &cui2vec.UncompressedEmbeddings{Comma: ',', Storage: cui2vec.DenseStorage}
+	if err := d.LoadModel(strings.NewReader(model)); err != nil {
+		t.Fatal(err)
+	}
+	if d.Dense == nil || d.Dense.Len() != 300 || d.Dense.Dims != 8 {
+		t.Fatalf("unexpected dense matrix %+v", d.Dense)
+	}
+	if row, ok := d.Dense.Vector("C0000007"); !ok || &row[0] != &d.Embeddings["C0000007"][0] {
+		t.Fatal("expected the map to hold views onto the dense matrix")
+	}
+
+	x, err := m.SimilarK("C0000042", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	y, err := d.SimilarK("C0000042", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range x {
+		if x[i] != y[i] {
+			t.Fatalf("dense concept %d differs: %v != %v", i, y[i], x[i])
+		}
+	}
+}
+
+func TestUncompressedVectorLayout(t *testing.T) {
+	model := "C0000001,0.1,0.2\nC0000002,0.3,0.4\n"
+	tests := []struct {
+		name    string
+		v       *cui2vec.UncompressedEmbeddings
+		compact bool
+		want    string
+	}{
+		{"map", &cui2vec.UncompressedEmbeddings{Comma: ','}, false, "[0 0.1 0.2]"},
+		{"dropped", &cui2vec.UncompressedEmbeddings{Comma: ',', DropCUIColumn: true}, false, "[0.1 0.2]"},
+		{"dense", &cui2vec.UncompressedEmbeddings{Comma: ',', Storage: cui2vec.DenseStorage}, false, "[0.1 0.2]"},
+		{"compacted", &cui2vec.UncompressedEmbeddings{Comma: ','}, true, "[0.1 0.2]"},
+	}
+	written := make(map[string]string)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.v.LoadModel(strings.NewReader(model)); err != nil {
+				t.Fatal(err)
+			}
+			if test.compact {
+				if err := test.v.Compact(); err != nil {
+					t.Fatal(err)
+				}
+				if test.v.Dense.Dims != 2 {
+					t.Errorf("expected 2 dimensions after compacting, got %d", test.v.Dense.Dims)
+				}
+			}
+			if got := fmt.Sprint(test.v.Embeddings["C0000001"]); got != test.want {
+				t.Errorf("got %s, expected %s", got, test.want)
+			}
+
+			// The zero is never written.
+			var buf bytes.Buffer
+			if err := test.v.WriteWord2Vec(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(buf.String(), "2 2\n") {
+				t.Errorf("unexpected header %q", buf.String()[:4])
+			}
+			written[test.name] = buf.String()
+		})
+	}
+	for name, w := range written {
+		if w != written["map"] {
+			t.Errorf("%s: wrote %q, expected %q", name, w, written["map"])
+		}
+	}
+
+	v, err := cui2vec.NewUncompressedEmbeddings(strings.NewReader(model), false, ',')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(v.Embeddings["C0000002"]) != "[0 0.3 0.4]" {
+		t.Errorf("unexpected map vector %v", v.Embeddings["C0000002"])
+	}
+	if v.Fingerprint() != loadValues(t, model).Fingerprint() {
+		t.Error("expected the same fingerprint with and without the cui column")
+	}
+}
+
+// benchmarkSimilarK measures SimilarK over a synthetic model the size of a small cui2vec model.
+func benchmarkSimilarK(b *testing.B, v *cui2vec.UncompressedEmbeddings) {
+	if err := v.LoadModel(strings.NewReader(syntheticModel(5000, 500))); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := v.SimilarK(cui2vec.Int2CUI(i%5000+1), 10); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSimilarK(b *testing.B) {
+	benchmarkSimilarK(b, &cui2vec.UncompressedEmbeddings{Comma: ','})
+}
+
+func BenchmarkSimilarKCachedNorms(b *testing.B) {
+	benchmarkSimilarK(b, &cui2vec.UncompressedEmbeddings{Comma: ',', CacheNorms: true})
+}
+
+func BenchmarkSimilarKNormalised(b *testing.B) {
+	benchmarkSimilarK(b, &cui2vec.UncompressedEmbeddings{Comma: ',', Normalise: true, Storage: cui2vec.DenseStorage})
+}
+
+func TestWord2Vec(t *testing.T) {
+	v := loadValues(t, syntheticModel(50, 4))
+	var buf bytes.Buffer
+	if err := v.WriteWord2Vec(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "50 4\n") {
+		t.Fatalf("unexpected header %q", buf.String()[:10])
+	}
+	w, err := cui2vec.NewWord2VecEmbeddings(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(w.Embeddings) != 50 {
+		t.Fatalf("expected 50 vectors, got %d", len(w.Embeddings))
+	}
+	for cui, vec := range v.Embeddings {
+		for i := range vec {
+			if math.Abs(vec[i]-w.Embeddings[cui][i]) > 1e-6 {
+				t.Fatalf("%s differs: %v != %v", cui, w.Embeddings[cui], vec)
+			}
+		}
+	}
+
+	if _, err := cui2vec.NewWord2VecEmbeddings(strings.NewReader("2 4\nC0000001 abc")); err == nil {
+		t.Error("expected an error for a truncated file")
+	}
+	for _, header := range []string{"0 4", "-1 4", "2 0", "2 -4", "2 4294967296", "9223372036854775807 4"} {
+		if _, err := cui2vec.NewWord2VecEmbeddings(strings.NewReader(header + "\nC0000001 abcdefghijklmnop")); err == nil {
+			t.Errorf("expected an error for the header %q", header)
+		}
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	var w2v bytes.Buffer
+	v := loadValues(t, syntheticModel(3, 2))
+	if err := v.WriteWord2Vec(&w2v); err != nil {
+		t.Fatal(err)
+	}
+
+	// Vectors of csv models keep the zero in place of the CUI column.
+	tests := []struct {
+		name   string
+		model  string
+		format cui2vec.Format
+		values int
+	}{
+		{"cui2vec", "\"\",V1,V2\n\"C0000001\",0.1,0.2\n\"C0000002\",0.3,0.4\n", cui2vec.Format{Name: "csv", Comma: ',', Header: true, Quoted: true, Dims: 2}, 3},
+		{"unquoted", "C0000001,0.1,0.2\nC0000002,0.3,0.4\n", cui2vec.Format{Name: "csv", Comma: ',', Dims: 2}, 3},
+		{"vec", "2 2\nC0000001 0.1 0.2 \nC0000002 0.3 0.4 \n", cui2vec.Format{Name: "vec", Comma: ' ', Header: true, Dims: 2}, 2},
+		{"tabs", "2 2\nC0000001\t0.1\t0.2\r\nC0000002\t0.3\t0.4\r\n", cui2vec.Format{Name: "vec", Comma: '\t', Header: true, Dims: 2}, 2},
+		{"word2vec", w2v.String(), cui2vec.Format{Name: "word2vec", Dims: 2}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v, format, err := cui2vec.LoadEmbeddings(strings.NewReader(test.model))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != test.format {
+				t.Errorf("detected %s, expected %s", format, test.format)
+			}
+			if len(v.Embeddings) < 2 {
+				t.Fatalf("expected at least 2 vectors, got %d", len(v.Embeddings))
+			}
+			for cui, vec := range v.Embeddings {
+				if len(vec) != test.values {
+					t.Errorf("%s has %d values, expected %d", cui, len(vec), test.values)
+				}
+			}
+		})
+	}
+}
+
+func TestMappedEmbeddings(t *testing.T) {
+	v := loadValues(t, syntheticModel(500, 13))
+	f, err := ioutil.TempFile("", "cui2vec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if err := v.WriteBinary(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := cui2vec.OpenMappedEmbeddings(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if m.Len() != 500 || m.Dims() != 13 {
+		t.Fatalf("expected 500 x 13 vectors, got %d x %d", m.Len(), m.Dims())
+	}
+
+	for _, cui := range []string{"C0000001", "C0000250", "C0000500"} {
+		vec, ok := m.Vector(cui)
+		if !ok {
+			t.Fatalf("%s is missing", cui)
+		}
+		for i := range vec {
+			if math.Abs(vec[i]-v.Embeddings[cui][i]) > 1e-6 {
+				t.Fatalf("%s differs: %v != %v", cui, vec, v.Embeddings[cui])
+			}
+		}
+
+		expected, err := v.SimilarK(cui, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := m.SimilarK(cui, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range expected {
+			if actual[i].CUI != expected[i].CUI || math.Abs(actual[i].Value-expected[i].Value) > 1e-5 {
+				t.Fatalf("concept %d of %s differs: %v != %v", i, cui, actual[i], expected[i])
+			}
+		}
+	}
+
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cui2vec.NewMappedEmbeddings(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cui2vec.NewMappedEmbeddings(bytes.NewReader(b[:len(b)-1])); err == nil {
+		t.Error("expected an error for a truncated model")
+	}
+
+	// The number of cuis, dimensions, stride and offset of the rows follow the magic bytes and version. Rows of one
+	// dimension fit more cuis into the file than the table before the rows holds.
+	offset := binary.LittleEndian.Uint32(b[20:])
+	for name, shape := range map[string][3]uint32{
+		"no dimensions": {binary.LittleEndian.Uint32(b[8:]), 0, 0},
+		"cui table":     {(uint32(len(b)) - offset) / 4, 1, 1},
+	} {
+		corrupt := append([]byte(nil), b...)
+		binary.LittleEndian.PutUint32(corrupt[8:], shape[0])
+		binary.LittleEndian.PutUint32(corrupt[12:], shape[1])
+		binary.LittleEndian.PutUint32(corrupt[16:], shape[2])
+		if _, err := cui2vec.NewMappedEmbeddings(bytes.NewReader(corrupt)); err == nil {
+			t.Errorf("%s: expected an error for a corrupt model", name)
+		}
+	}
+}
+
+func TestPrecomputedHeader(t *testing.T) {
+	p := &cui2vec.PrecomputedEmbeddings{
+		Cols:   6,
+		Metric: "euclidean",
+		Matrix: [][]int{
+			1: {3, 5000000, 4, 2000000, 5, 1000000},
+			4: {1, 4000000, 3, 3000000},
+		},
+	}
+	var buf bytes.Buffer
+	if err := p.WriteModel(&buf); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+
+	q, err := cui2vec.NewPrecomputedEmbeddings(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Cols != 6 || q.Metric != "euclidean" || q.Encoding != cui2vec.EncodingFixedPoint || len(q.Matrix) != 5 {
+		t.Fatalf("unexpected header: %d columns, %s, %s, size %d", q.Cols, q.Metric, q.Encoding, len(q.Matrix))
+	}
+	if fmt.Sprint(q.Matrix[1]) != fmt.Sprint(p.Matrix[1]) || fmt.Sprint(q.Matrix[4]) != "[1 4000000 3 3000000 0 0]" {
+		t.Fatalf("unexpected matrix %v", q.Matrix)
+	}
+
+	corrupt := append([]byte(nil), b...)
+	corrupt[len(corrupt)-5] ^= 1
+	if _, err := cui2vec.NewPrecomputedEmbeddings(bytes.NewReader(corrupt)); err == nil {
+		t.Error("expected an error for a corrupt model")
+	}
+	flagged := append([]byte(nil), b...)
+	flagged[20] = 1
+	if _, err := cui2vec.NewPrecomputedEmbeddings(bytes.NewReader(flagged)); err == nil {
+		t.Error("expected an error for unknown flags")
+	}
+	if _, err := cui2vec.NewPrecomputedEmbeddings(bytes.NewReader(b[:len(b)-1])); err == nil {
+		t.Error("expected an error for a truncated model")
+	}
+
+	// Legacy files are the size of the matrix followed by rows of 20 columns.
+	legacy := []byte{5, 0, 0, 0, 1, 0, 0, 0}
+	for i := 0; i < 20; i++ {
+		legacy = append(legacy, byte(i+1), 0, 0, 0)
+	}
+	q, err = cui2vec.NewPrecomputedEmbeddings(bytes.NewReader(legacy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Cols != 20 || len(q.Matrix) != 5 || q.Matrix[1][19] != 20 {
+		t.Fatalf("unexpected legacy matrix %v", q.Matrix)
+	}
+}
+
+func TestPrecomputedFloat32(t *testing.T) {
+	model := "C0000001,1,0\nC0000002,1,1\nC0000003,0,1\n"
+	v, err := cui2vec.NewUncompressedEmbeddings(strings.NewReader(model), false, ',')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A fixed-point score with small leading digits, which must not be scaled up.
+	p := &cui2vec.PrecomputedEmbeddings{
+		Cols:   4,
+		Matrix: [][]int{1: {2, 512345, 3, 50}},
+	}
+	concepts, err := p.Similar("C0000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(concepts[0].Value-0.0512345) > 1e-12 || math.Abs(concepts[1].Value-0.000005) > 1e-12 {
+		t.Fatalf("unexpected fixed-point scores %v", concepts)
+	}
+	p.Score = cui2vec.ScoreRaw
+	if _, err := p.Similar("C0000001"); err == nil {
+		t.Error("expected an error for raw fixed-point scores")
+	}
+
+	if err := p.Migrate(v); err != nil {
+		t.Fatal(err)
+	}
+	if p.Encoding != cui2vec.EncodingFloat32 || p.Cols != 6 || p.Metric != "cosine" {
+		t.Fatalf("unexpected migrated header: %s, %d columns, %s", p.Encoding, p.Cols, p.Metric)
+	}
+	var buf bytes.Buffer
+	if err := p.WriteModel(&buf); err != nil {
+		t.Fatal(err)
+	}
+	q, err := cui2vec.NewPrecomputedEmbeddings(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := v.SimilarK("C0000001", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Score = cui2vec.ScoreRaw
+	concepts, err = q.Similar("C0000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range raw {
+		if concepts[i].CUI != raw[i].CUI || math.Abs(concepts[i].Value-raw[i].Value) > 1e-6 {
+			t.Fatalf("raw concept %d differs: %v != %v", i, concepts[i], raw[i])
+		}
+	}
+	q.Score = cui2vec.ScoreSoftmax
+	concepts, err = q.Similar("C0000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(concepts[0].Value-0.0512345) > 1e-6 {
+		t.Fatalf("unexpected migrated softmax scores %v", concepts)
+	}
+}
+
+func TestPrecomputedCorrupt(t *testing.T) {
+	row := func(vals ...byte) []byte {
+		b := make([]byte, 0, 21*4)
+		for i := 0; i < 21; i++ {
+			var v byte
+			if i < len(vals) {
+				v = vals[i]
+			}
+			b = append(b, v, 0, 0, 0)
+		}
+		return b
+	}
+	legacy := func(size byte, rows ...[]byte) []byte {
+		b := []byte{size, 0, 0, 0}
+		for _, r := range rows {
+			b = append(b, r...)
+		}
+		return b
+	}
+
+	tests := []struct {
+		name  string
+		model []byte
+	}{
+		{"empty", nil},
+		{"short size", []byte{5, 0}},
+		{"truncated row", legacy(5, row(1, 2, 3))[:50]},
+		{"index equal to size", legacy(5, row(5, 2, 3))},
+		{"index beyond size", legacy(5, row(1, 2, 3), row(200))},
+		{"huge size", append([]byte{0xff, 0xff, 0xff, 0xff}, row(0xff)[:10]...)},
+		{"forged size", append([]byte{0xff, 0xff, 0xff, 0xff}, append(row(4, 2, 3), row(1, 3, 4)...)...)},
+		{"truncated header", []byte("C2VP\x01\x00\x00\x00\x05")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &cui2vec.PrecomputedEmbeddings{Cols: 20}
+			if err := p.LoadModel(bytes.NewReader(test.model)); err == nil {
+				t.Error("expected an error")
+			}
+			if p.Matrix != nil {
+				t.Error("expected the matrix to be unchanged")
+			}
+		})
+	}
+
+	p := &cui2vec.PrecomputedEmbeddings{Cols: 20}
+	if err := p.LoadModel(bytes.NewReader(legacy(5, row(4, 2, 3), row(1, 3, 4)))); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Matrix) != 5 || p.Matrix[4][0] != 2 || p.Matrix[1][1] != 4 {
+		t.Fatalf("unexpected matrix %v", p.Matrix)
+	}
+}
+
+func TestCompressedModels(t *testing.T) {
+	model := syntheticModel(20, 3)
+	for _, c := range []cui2vec.Compression{cui2vec.NoCompression, cui2vec.Gzip, cui2vec.Zstd} {
+		t.Run(c.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := cui2vec.NewCompressedWriter(&buf, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write([]byte(model)); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			detected, err := cui2vec.DetectCompression(bufio.NewReader(bytes.NewReader(buf.Bytes())))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if detected != c {
+				t.Errorf("detected %s, expected %s", detected, c)
+			}
+
+			v, err := cui2vec.NewUncompressedEmbeddings(bytes.NewReader(buf.Bytes()), false, ',')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(v.Embeddings) != 20 {
+				t.Fatalf("expected 20 vectors, got %d", len(v.Embeddings))
+			}
+			v, _, err = cui2vec.LoadEmbeddings(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(v.Embeddings) != 20 {
+				t.Fatalf("expected 20 detected vectors, got %d", len(v.Embeddings))
+			}
+		})
+	}
+
+	if _, err := cui2vec.NewCompressedWriter(ioutil.Discard, cui2vec.Bzip2); err == nil {
+		t.Error("expected an error writing bzip2")
+	}
+}
+
+func TestCompressedMapping(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cui2vec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/mapping.csv.zst"
+	w, err := cui2vec.CreateCompressed(path, cui2vec.CompressionByExtension(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("5,(131)i-maa\n39,dipalmitoylphosphatidylcholine\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := cui2vec.LoadCUIMapping(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m["C0000039"] != "dipalmitoylphosphatidylcholine" {
+		t.Errorf("unexpected mapping %v", m)
+	}
+}
+
+func TestNumPy(t *testing.T) {
+	v := loadValues(t, syntheticModel(30, 5))
+
+	var matrix, vocab bytes.Buffer
+	if err := v.WriteNumPy(&matrix, &vocab); err != nil {
+		t.Fatal(err)
+	}
+	b := matrix.Bytes()
+	if !bytes.HasPrefix(b, []byte("\x93NUMPY\x01\x00")) {
+		t.Fatalf("unexpected magic %q", b[:8])
+	}
+	header := 10 + int(b[8]) | int(b[9])<<8
+	if header%64 != 0 || len(b)-header != 30*5*4 {
+		t.Fatalf("unexpected header length %d for %d bytes", header, len(b))
+	}
+	if !strings.Contains(string(b[10:header]), "'shape': (30, 5)") {
+		t.Errorf("unexpected header %q", b[10:header])
+	}
+
+	w, err := cui2vec.NewNumPyEmbeddings(bytes.NewReader(b), bytes.NewReader(vocab.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(w.Embeddings) != 30 {
+		t.Fatalf("expected 30 vectors, got %d", len(w.Embeddings))
+	}
+	for cui, vec := range v.Embeddings {
+		for j := range vec {
+			if math.Abs(w.Embeddings[cui][j]-vec[j]) > 1e-6 {
+				t.Fatalf("%s differs: %v != %v", cui, w.Embeddings[cui], vec)
+			}
+		}
+	}
+
+	lines := strings.Split(vocab.String(), "\n")
+	short := strings.Join(lines[:29], "\n")
+	if _, err := cui2vec.NewNumPyEmbeddings(bytes.NewReader(b), strings.NewReader(short)); err == nil {
+		t.Error("expected an error for a vocabulary with too few cuis")
+	}
+	if _, err := cui2vec.NewNumPyEmbeddings(bytes.NewReader(b[:len(b)-4]), bytes.NewReader(vocab.Bytes())); err == nil {
+		t.Error("expected an error for a truncated matrix")
+	}
+
+	// Malformed shapes are rejected before the matrix is allocated.
+	withShape := func(shape string) []byte {
+		dict := strings.Replace(string(b[10:header]), "(30, 5)", shape, 1)
+		m := append([]byte("\x93NUMPY\x01\x00\x00\x00"), dict...)
+		binary.LittleEndian.PutUint16(m[8:], uint16(len(dict)))
+		return append(m, b[header:]...)
+	}
+	if _, err := cui2vec.NewNumPyEmbeddings(bytes.NewReader(withShape("(30, 5)")), bytes.NewReader(vocab.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	for _, shape := range []string{"(30, 0)", "(30, -5)", "(-30, 5)", "(29, 5)", "(30, 4611686018427387904)"} {
+		if _, err := cui2vec.NewNumPyEmbeddings(bytes.NewReader(withShape(shape)), bytes.NewReader(vocab.Bytes())); err == nil {
+			t.Errorf("expected an error for the shape %s", shape)
+		}
+	}
+
+	p := &cui2vec.PrecomputedEmbeddings{
+		Cols:     6,
+		Encoding: cui2vec.EncodingFloat32,
+		Matrix:   [][]int{2: {3, int(math.Float32bits(0.5)), int(math.Float32bits(0.25))}},
+	}
+	var npz bytes.Buffer
+	if err := p.WriteNumPyZ(&npz); err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(npz.Bytes()), int64(npz.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range z.File {
+		names = append(names, f.Name)
+	}
+	if strings.Join(names, " ") != "cuis.npy neighbours.npy scores.npy raw.npy" {
+		t.Fatalf("unexpected arrays %v", names)
+	}
+	r, err := z.File[1].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	neighbours, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(neighbours); n%64 != 8 || !bytes.Equal(neighbours[n-8:], []byte{3, 0, 0, 0, 0xff, 0xff, 0xff, 0xff}) {
+		t.Fatalf("unexpected neighbours %q", neighbours)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	load := func(model string) *cui2vec.UncompressedEmbeddings {
+		v, err := cui2vec.NewUncompressedEmbeddings(strings.NewReader(model), false, ',')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	a := cui2vec.Source{Name: "a", Embeddings: load("C0000001,1,2\nC0000002,3,4\n")}
+	b := cui2vec.Source{Name: "b", Embeddings: load("C0000002,5,6\nC0000003,7,8\n")}
+	c := cui2vec.Source{Name: "c", Embeddings: load("C0000001,1,2,3\n")}
+
+	tests := []struct {
+		policy  cui2vec.MergePolicy
+		sources []cui2vec.Source
+		want    map[string][]float64
+	}{
+		{cui2vec.PreferFirst, []cui2vec.Source{a, b}, map[string][]float64{"C0000001": {1, 2}, "C0000002": {3, 4}, "C0000003": {7, 8}}},
+		{cui2vec.Average, []cui2vec.Source{a, b}, map[string][]float64{"C0000001": {1, 2}, "C0000002": {4, 5}, "C0000003": {7, 8}}},
+		{cui2vec.Concatenate, []cui2vec.Source{a, c}, map[string][]float64{"C0000001": {1, 2, 1, 2, 3}, "C0000002": {3, 4, 0, 0, 0}}},
+	}
+	for _, test := range tests {
+		t.Run(test.policy.String(), func(t *testing.T) {
+			m, err := cui2vec.Merge(test.policy, test.sources...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(m.Embeddings) != len(test.want) {
+				t.Fatalf("unexpected embeddings %v", m.Embeddings)
+			}
+			for cui, want := range test.want {
+				if fmt.Sprint(m.Embeddings[cui]) != fmt.Sprint(want) {
+					t.Errorf("%s: got %v, expected %v", cui, m.Embeddings[cui], want)
+				}
+			}
+		})
+	}
+
+	m, err := cui2vec.Merge(cui2vec.PreferFirst, b, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(m.Sources["C0000002"]) != "[b]" || fmt.Sprint(m.Sources["C0000001"]) != "[a]" {
+		t.Errorf("unexpected sources %v", m.Sources)
+	}
+	if fmt.Sprint(m.Embeddings["C0000002"]) != "[5 6]" {
+		t.Errorf("expected the vector of the first source, got %v", m.Embeddings["C0000002"])
+	}
+	m, err = cui2vec.Merge(cui2vec.Average, a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(m.Sources["C0000002"]) != "[a b]" {
+		t.Errorf("unexpected averaged sources %v", m.Sources)
+	}
+	if _, err := cui2vec.Merge(cui2vec.Average, a, c); err == nil {
+		t.Error("expected an error for incompatible dimensions")
+	}
+
+	dir, err := ioutil.TempDir("", "cui2vec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	model := strings.Split(syntheticModel(30, 4), "\n")
+	for i := 0; i < 3; i++ {
+		shard := fmt.Sprintf("%s/model-%05d-of-00003.csv", dir, i+1)
+		if err := ioutil.WriteFile(shard, []byte(strings.Join(model[i*10:(i+1)*10], "\n")), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	paths, ok, err := cui2vec.ShardPaths(dir + "/model-00002-of-00003.csv")
+	if err != nil || !ok || len(paths) != 3 {
+		t.Fatalf("unexpected shards %v, %v, %v", paths, ok, err)
+	}
+	// Both shards belong to the same model, so it is only loaded once.
+	m, err = cui2vec.MergeFiles(cui2vec.Concatenate, dir+"/model-00001-of-00003.csv", dir+"/model-00003-of-00003.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Embeddings) != 30 || len(m.Embeddings["C0000030"]) != 4 {
+		t.Fatalf("expected 30 vectors of 4 dimensions, got %d of %d", len(m.Embeddings), len(m.Embeddings["C0000030"]))
+	}
+	if fmt.Sprint(m.Sources["C0000030"]) != "["+dir+"/model-00001-of-00003.csv]" {
+		t.Errorf("unexpected sources %v", m.Sources["C0000030"])
+	}
+
+	if _, err := cui2vec.LoadShards(paths[0], paths[0]); err == nil {
+		t.Error("expected an error for a cui in more than one shard")
+	}
+	if err := os.Remove(paths[2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cui2vec.LoadSource(paths[0]); err == nil {
+		t.Error("expected an error for a missing shard")
+	}
+}
+
+func TestAllPairs(t *testing.T) {
+	v, err := cui2vec.NewUncompressedEmbeddings(strings.NewReader(syntheticModel(150, 8)), false, ',')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, metric := range cui2vec.Metrics {
+		t.Run(metric.Name(), func(t *testing.T) {
+			a, err := cui2vec.NewAllPairs(v, metric, 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Small blocks that do not divide the number of CUIs exercise the edges of each block.
+			a.QueryBlock, a.CandidateBlock = 7, 40
+
+			seen := make(map[string]bool)
+			err = a.Compute(nil, func(n cui2vec.Neighbours) error {
+				if seen[n.CUI] {
+					t.Errorf("%s computed twice", n.CUI)
+				}
+				seen[n.CUI] = true
+				want, err := v.SimilarMetric(n.CUI, 5, metric)
+				if err != nil {
+					return err
+				}
+				if len(n.Concepts) != len(want) || len(n.Softmax) != len(want) {
+					t.Fatalf("%s: expected %d neighbours, got %d", n.CUI, len(want), len(n.Concepts))
+				}
+				for i := range want {
+					if n.Concepts[i].CUI != want[i].CUI || math.Abs(n.Concepts[i].Value-want[i].Value) > 1e-9 {
+						t.Fatalf("%s: neighbour %d is %v, expected %v", n.CUI, i, n.Concepts[i], want[i])
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(seen) != 150 {
+				t.Errorf("expected 150 cuis, got %d", len(seen))
+			}
+		})
+	}
+
+	a, err := cui2vec.NewAllPairs(v, cui2vec.CosineMetric, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &cui2vec.PrecomputedEmbeddings{Cols: 9, Encoding: cui2vec.EncodingFloat32}
+	err = a.Compute([]string{"C0000010", "C0000020", "C9999999"}, p.SetNeighbours)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := v.SimilarKSoftmax("C0000020", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := p.Similar("C0000020")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range want {
+		if got[i].CUI != want[i].CUI || math.Abs(got[i].Value-want[i].Value) > 1e-6 {
+			t.Fatalf("softmax neighbour %d is %v, expected %v", i, got[i], want[i])
+		}
+	}
+	if len(p.Matrix) != 21 || len(p.Matrix[10]) != 9 {
+		t.Errorf("unexpected matrix of %d rows", len(p.Matrix))
+	}
+
+	// With a minimum score, every neighbour scoring at least it is kept, without changing the softmax scores.
+	all, err := cui2vec.NewAllPairs(v, cui2vec.CosineMetric, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	min := 0.5
+	all.MinScore = &min
+	err = all.Compute([]string{"C0000020"}, func(n cui2vec.Neighbours) error {
+		scores, err := v.SimilarK("C0000020", 0)
+		if err != nil {
+			return err
+		}
+		want := 0
+		for _, c := range scores {
+			if c.Value >= min {
+				want++
+			}
+		}
+		if len(n.Concepts) != want || want <= 3 {
+			t.Fatalf("expected %d neighbours scoring at least %f, got %d", want, min, len(n.Concepts))
+		}
+		for i := range got {
+			if math.Abs(n.Softmax[i]-got[i].Value) > 1e-6 {
+				t.Fatalf("softmax of neighbour %d is %f, expected %f", i, n.Softmax[i], got[i].Value)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = a.Compute(nil, func(cui2vec.Neighbours) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("expected to stop after the first error, got %v after %d calls", err, calls)
+	}
+
+	// Cancelling stops the worker before its next block of candidates.
+	cancel := make(chan struct{})
+	a.QueryBlock, a.CandidateBlock, a.Workers, a.Cancel = 1, 10, 1, cancel
+	calls = 0
+	err = a.Compute(nil, func(cui2vec.Neighbours) error {
+		calls++
+		close(cancel)
+		return nil
+	})
+	if err != cui2vec.ErrCancelled || calls != 1 {
+		t.Errorf("expected to be cancelled after the first block, got %v after %d calls", err, calls)
+	}
+}
+
+func TestPrecomputedShards(t *testing.T) {
+	v, err := cui2vec.NewUncompressedEmbeddings(strings.NewReader(syntheticModel(60, 4)), false, ',')
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := cui2vec.NewAllPairs(v, cui2vec.CosineMetric, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := &cui2vec.PrecomputedEmbeddings{Cols: 9, Encoding: cui2vec.EncodingFloat32}
+	if err := a.Compute(nil, full.SetNeighbours); err != nil {
+		t.Fatal(err)
+	}
+
+	// Compute each shard, and read it back from disk.
+	shard := func(i, n int) *cui2vec.PrecomputedEmbeddings {
+		var cuis []string
+		for cui := range v.Embeddings {
+			if s, err := cui2vec.ShardOf(cui, n); err != nil {
+				t.Fatal(err)
+			} else if s == i {
+				cuis = append(cuis, cui)
+			}
+		}
+		p := &cui2vec.PrecomputedEmbeddings{
+			Cols:        9,
+			Encoding:    cui2vec.EncodingFloat32,
+			Metric:      "cosine",
+			Fingerprint: v.Fingerprint(),
+			Shard:       i,
+			Shards:      n,
+			Expected:    len(cuis),
+		}
+		if err := a.Compute(cuis, p.SetNeighbours); err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		if err := p.WriteModel(&b); err != nil {
+			t.Fatal(err)
+		}
+		q := &cui2vec.PrecomputedEmbeddings{}
+		if err := q.LoadModel(&b); err != nil {
+			t.Fatal(err)
+		}
+		if q.Fingerprint != p.Fingerprint || q.Shard != i || q.Shards != n || q.Expected != len(cuis) {
+			t.Fatalf("shard %d/%d read back as %d/%d with %d rows", i, n, q.Shard, q.Shards, q.Expected)
+		}
+		return q
+	}
+	shards := []*cui2vec.PrecomputedEmbeddings{shard(3, 3), shard(1, 3), shard(2, 3)}
+
+	merged, err := cui2vec.MergePrecomputed(shards...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.Expected != 60 || merged.Shards != 0 {
+		t.Errorf("expected 60 rows and no shards, got %d rows of %d shards", merged.Expected, merged.Shards)
+	}
+	for cui := range v.Embeddings {
+		c, _ := cui2vec.CUI2Int(cui)
+		if fmt.Sprint(merged.Matrix[c]) != fmt.Sprint(full.Matrix[c]) {
+			t.Fatalf("%s: merged row differs from the unsharded row", cui)
+		}
+	}
+
+	other := shard(2, 3)
+	other.Fingerprint++
+	short := shard(2, 3)
+	for i, row := range short.Matrix {
+		if row != nil {
+			short.Matrix[i] = nil
+			break
+		}
+	}
+	misplaced := shard(2, 3)
+	misplaced.Matrix[3] = full.Matrix[3]
+	variable := shard(2, 3)
+	variable.VariableRows = true
+
+	for _, tc := range []struct {
+		name   string
+		shards []*cui2vec.PrecomputedEmbeddings
+	}{
+		{"missing shard", shards[:2]},
+		{"duplicate shard", []*cui2vec.PrecomputedEmbeddings{shards[0], shards[1], shards[1]}},
+		{"different model", []*cui2vec.PrecomputedEmbeddings{shards[0], shards[1], other}},
+		{"different shards", []*cui2vec.PrecomputedEmbeddings{shards[0], shards[1], shard(2, 4)}},
+		{"missing row", []*cui2vec.PrecomputedEmbeddings{shards[0], shards[1], short}},
+		{"overlapping row", []*cui2vec.PrecomputedEmbeddings{shards[0], shards[1], misplaced}},
+		{"variable rows", []*cui2vec.PrecomputedEmbeddings{shards[0], shards[1], variable}},
+	} {
+		if _, err := cui2vec.MergePrecomputed(tc.shards...); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
+
+func TestPrecomputedVariableRows(t *testing.T) {
+	v, err := cui2vec.NewUncompressedEmbeddings(strings.NewReader(syntheticModel(50, 4)), false, ',')
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := cui2vec.NewAllPairs(v, cui2vec.CosineMetric, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Some rows keep fewer neighbours, and some keep none.
+	selected := make(map[string]int)
+	p := &cui2vec.PrecomputedEmbeddings{Cols: 15, Encoding: cui2vec.EncodingFloat32, Metric: "cosine"}
+	err = a.Compute(nil, func(n cui2vec.Neighbours) error {
+		switch c, _ := cui2vec.CUI2Int(n.CUI); c % 3 {
+		case 1:
+			n = n.Top(2)
+		case 2:
+			n = n.AtLeast(2)
+		}
+		selected[n.CUI] = len(n.Concepts)
+		return p.SetNeighbours(n)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fixed, variable bytes.Buffer
+	if err := p.WriteModel(&fixed); err != nil {
+		t.Fatal(err)
+	}
+	p.VariableRows = true
+	if err := p.WriteModel(&variable); err != nil {
+		t.Fatal(err)
+	}
+	if variable.Len() >= fixed.Len() {
+		t.Errorf("expected variable rows to be smaller than %d bytes, got %d", fixed.Len(), variable.Len())
+	}
+
+	for name, b := range map[string]*bytes.Buffer{"fixed": &fixed, "variable": &variable} {
+		q := &cui2vec.PrecomputedEmbeddings{}
+		if err := q.LoadModel(b); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if q.VariableRows != (name == "variable") {
+			t.Errorf("%s: read back with VariableRows %v", name, q.VariableRows)
+		}
+		for cui, k := range selected {
+			c, _ := cui2vec.CUI2Int(cui)
+			// Fixed rows that were empty are not written at all.
+			if name == "variable" && (q.Matrix[c] == nil || len(q.Matrix[c]) != 3*k) {
+				t.Fatalf("%s: %s has %d values, expected %d", name, cui, len(q.Matrix[c]), 3*k)
+			}
+			concepts, err := q.Similar(cui)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(concepts) != k {
+				t.Fatalf("%s: %s has %d neighbours, expected %d", name, cui, len(concepts), k)
+			}
+			for _, concept := range concepts {
+				if concept.CUI == "C0000000" || math.IsNaN(concept.Value) {
+					t.Fatalf("%s: %s has padding %v as a neighbour", name, cui, concept)
+				}
+			}
+		}
+	}
+
+	// A row that is longer than the header allows is corrupt.
+	var b bytes.Buffer
+	p.Cols = 3
+	p.Matrix = [][]int{nil, {2, 0, 0}}
+	if err := p.WriteModel(&b); err != nil {
+		t.Fatal(err)
+	}
+	// The row is given a fourth value, and the checksum that precedes it is recomputed, so that only its length is
+	// wrong.
+	data := append(b.Bytes(), 0, 0, 0, 0)
+	row := len(data) - 24
+	binary.LittleEndian.PutUint32(data[row+4:], 4)
+	h := crc32.NewIEEE()
+	h.Write(data[:row-4])
+	h.Write(data[row:])
+	binary.LittleEndian.PutUint32(data[row-4:], h.Sum32())
+	if err := (&cui2vec.PrecomputedEmbeddings{}).LoadModel(bytes.NewReader(data)); err == nil {
+		t.Error("expected an error for a row that is too long")
+	}
+}
+
+func TestReverseIndex(t *testing.T) {
+	v, err := cui2vec.NewUncompressedEmbeddings(strings.NewReader(syntheticModel(80, 6)), false, ',')
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := cui2vec.NewReverseIndexFromEmbeddings(v, cui2vec.CosineMetric, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every neighbour of a CUI lists that CUI in reverse, at the same rank and with the same score.
+	for cui := range v.Embeddings {
+		neighbours, err := v.SimilarMetric(cui, 4, cui2vec.CosineMetric)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, n := range neighbours {
+			reverse, err := r.ReverseSimilar(n.CUI)
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := false
+			for _, rn := range reverse {
+				if rn.CUI == cui {
+					found = rn.Rank == i+1 && math.Abs(rn.Value-n.Value) < 1e-9
+				}
+			}
+			if !found {
+				t.Fatalf("%s does not list %s at rank %d", n.CUI, cui, i+1)
+			}
+		}
+	}
+
+	h := r.Hubness(3)
+	if h.CUIs != 80 || h.Indexed != 80 || h.K != 4 || math.Abs(h.Mean-4) > 1e-9 {
+		t.Errorf("unexpected hubness %+v", h)
+	}
+	if len(h.Hubs) != 3 || int(h.Hubs[0].Value) != r.Occurrences(h.Hubs[0].CUI) || h.Hubs[0].Value < h.Hubs[2].Value {
+		t.Errorf("unexpected hubs %v", h.Hubs)
+	}
+
+	// C0000001 is a hub, and C0000004 is an anti-hub.
+	p := &cui2vec.PrecomputedEmbeddings{Cols: 6, Encoding: cui2vec.EncodingFloat32}
+	for _, n := range []cui2vec.Neighbours{
+		{CUI: "C0000002", Concepts: []cui2vec.Concept{{CUI: "C0000001", Value: 0.9}, {CUI: "C0000003", Value: 0.5}}, Softmax: []float64{0.6, 0.4}},
+		{CUI: "C0000003", Concepts: []cui2vec.Concept{{CUI: "C0000002", Value: 0.8}, {CUI: "C0000001", Value: 0.7}}, Softmax: []float64{0.55, 0.45}},
+		{CUI: "C0000004", Concepts: []cui2vec.Concept{{CUI: "C0000001", Value: 0.2}}, Softmax: []float64{1}},
+	} {
+		if err := p.SetNeighbours(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.Score = cui2vec.ScoreRaw
+	r, err = cui2vec.NewReverseIndex(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reverse, err := r.ReverseSimilar("C0000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []cui2vec.ReverseNeighbour{{CUI: "C0000002", Rank: 1, Value: 0.9}, {CUI: "C0000004", Rank: 1, Value: 0.2}, {CUI: "C0000003", Rank: 2, Value: 0.7}}
+	if len(reverse) != len(want) {
+		t.Fatalf("expected %v, got %v", want, reverse)
+	}
+	for i := range want {
+		if reverse[i].CUI != want[i].CUI || reverse[i].Rank != want[i].Rank || math.Abs(reverse[i].Value-want[i].Value) > 1e-6 {
+			t.Fatalf("expected %v, got %v", want, reverse)
+		}
+	}
+
+	h = r.Hubness(1)
+	if h.CUIs != 4 || h.Indexed != 3 || h.AntiHubs != 1 || h.Hubs[0].CUI != "C0000001" || h.Skewness <= 0 {
+		t.Errorf("unexpected hubness %+v", h)
+	}
+	if _, err := r.ReverseSimilar("not a cui"); err == nil {
+		t.Error("expected an error for a malformed cui")
+	}
+}
+
+func TestPrecomputedInspect(t *testing.T) {
+	v, err := cui2vec.NewUncompressedEmbeddings(strings.NewReader(syntheticModel(40, 4)), false, ',')
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := cui2vec.NewAllPairs(v, cui2vec.CosineMetric, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &cui2vec.PrecomputedEmbeddings{Cols: 12, Encoding: cui2vec.EncodingFloat32, Metric: "cosine", Expected: 40}
+	if err := a.Compute(nil, p.SetNeighbours); err != nil {
+		t.Fatal(err)
+	}
+	// Padding at the end of a row is expected.
+	p.Matrix[5] = append(p.Matrix[5][:6:6], 0, 0, 0, 0, 0, 0)
+
+	in := p.Inspect(10)
+	if in.Corrupt() {
+		t.Fatalf("expected no problems, got %v: %v", in.Problems, in.Examples)
+	}
+	if in.Rows != 41 || in.Populated != 40 || in.Padded != 1 || in.Neighbours != 40*4-2 {
+		t.Errorf("unexpected inspection %+v", in)
+	}
+
+	swap := func(row []int) {
+		for j := 0; j < 3; j++ {
+			row[j], row[3+j] = row[3+j], row[j]
+		}
+	}
+	p.Matrix[1] = append(p.Matrix[1], 0)
+	p.Matrix[2][3] = 99999999
+	p.Matrix[3][0] = 3
+	p.Matrix[4][3] = p.Matrix[4][0]
+	p.Matrix[5][8], p.Matrix[5][9] = 1, 39999
+	p.Matrix[6][5] = int(math.Float32bits(float32(math.NaN())))
+	swap(p.Matrix[7])
+	p.Matrix = append(p.Matrix, nil, nil, nil)
+
+	in = p.Inspect(3)
+	want := map[cui2vec.Problem]int{
+		cui2vec.ProblemColumns:       1,
+		cui2vec.ProblemInvalidCUI:    1,
+		cui2vec.ProblemSelfReference: 1,
+		cui2vec.ProblemDuplicate:     1,
+		cui2vec.ProblemPadding:       2,
+		cui2vec.ProblemScore:         1,
+		cui2vec.ProblemOrder:         1,
+	}
+	if !in.Corrupt() || fmt.Sprint(in.Problems) != fmt.Sprint(want) {
+		t.Errorf("expected problems %v, got %v", want, in.Problems)
+	}
+	if len(in.Examples) != 3 || len(in.Kinds()) != len(want) {
+		t.Errorf("expected 3 examples of %d kinds, got %v of %v", len(want), in.Examples, in.Kinds())
+	}
+
+	p.Matrix[8] = nil
+	if in := p.Inspect(0); in.Problems[cui2vec.ProblemRows] != 1 {
+		t.Errorf("expected a missing row, got %v", in.Problems)
+	}
+}
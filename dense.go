@@ -0,0 +1,114 @@
+package cui2vec
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Storage determines how the vectors of UncompressedEmbeddings are laid out in memory.
+type Storage int
+
+const (
+	// MapStorage stores each vector as a separate allocation in the Embeddings map.
+	MapStorage Storage = iota
+	// DenseStorage stores every vector as a row of a single contiguous DenseMatrix. The Embeddings map still holds
+	// every vector, but each vector is a view onto a row of the matrix rather than a separate allocation.
+	DenseStorage
+)
+
+// DenseMatrix is a contiguous, row-major matrix of vectors where each row belongs to a CUI.
+// Rows maps each CUI to its row, and CUIs maps each row back to its CUI.
+type DenseMatrix struct {
+	Data []float64
+	Dims int
+	Rows map[string]int
+	CUIs []string
+}
+
+// NewDenseMatrix copies a map of vectors into a contiguous matrix, where the rows are ordered by CUI.
+// Every vector must have the same number of dimensions.
+func NewDenseMatrix(embeddings map[string][]float64) (*DenseMatrix, error) {
+	cuis := make([]string, 0, len(embeddings))
+	for cui := range embeddings {
+		cuis = append(cuis, cui)
+	}
+	sort.Strings(cuis)
+
+	m := &DenseMatrix{
+		Rows: make(map[string]int, len(cuis)),
+		CUIs: cuis,
+	}
+	if len(cuis) > 0 {
+		m.Dims = len(embeddings[cuis[0]])
+	}
+	m.Data = make([]float64, len(cuis)*m.Dims)
+
+	for i, cui := range cuis {
+		vec := embeddings[cui]
+		if len(vec) != m.Dims {
+			return nil, fmt.Errorf("%s has %d dimensions, expected %d", cui, len(vec), m.Dims)
+		}
+		copy(m.Row(i), vec)
+		m.Rows[cui] = i
+	}
+	return m, nil
+}
+
+// Len is the number of rows in the matrix.
+func (m *DenseMatrix) Len() int {
+	return len(m.CUIs)
+}
+
+// Row returns a view onto the i-th row of the matrix.
+func (m *DenseMatrix) Row(i int) []float64 {
+	return m.Data[i*m.Dims : (i+1)*m.Dims : (i+1)*m.Dims]
+}
+
+// Vector returns a view onto the row of the matrix for a CUI.
+func (m *DenseMatrix) Vector(cui string) ([]float64, bool) {
+	i, ok := m.Rows[cui]
+	if !ok {
+		return nil, false
+	}
+	return m.Row(i), true
+}
+
+// valueMatrix copies the vectors of the embeddings into a contiguous matrix, without the zero that stands in for the
+// CUI column.
+func (v *UncompressedEmbeddings) valueMatrix() (*DenseMatrix, error) {
+	if !v.hasCUIColumn() {
+		return NewDenseMatrix(v.Embeddings)
+	}
+	values := make(map[string][]float64, len(v.Embeddings))
+	for cui, vec := range v.Embeddings {
+		values[cui] = v.values(vec)
+	}
+	return NewDenseMatrix(values)
+}
+
+// Compact moves the vectors of the embeddings into a single contiguous DenseMatrix, and replaces each vector in the
+// Embeddings map with a view onto its row. As with DenseStorage, the rows hold only the values of the model, without
+// the zero in place of the CUI column. Compact must be called again if vectors are added to the Embeddings map,
+// otherwise the added vectors are only found by scanning the map.
+func (v *UncompressedEmbeddings) Compact() error {
+	m, err := v.valueMatrix()
+	if err != nil {
+		return err
+	}
+	embeddings := make(map[string][]float64, m.Len())
+	for i, cui := range m.CUIs {
+		embeddings[cui] = m.Row(i)
+	}
+	v.Embeddings = embeddings
+	v.Dense = m
+	v.Storage = DenseStorage
+	return nil
+}
+
+// dense returns the dense matrix of the embeddings, or nil if the vectors are not all held in it.
+func (v *UncompressedEmbeddings) dense() *DenseMatrix {
+	if v.Dense == nil || v.Dense.Len() != len(v.Embeddings) {
+		return nil
+	}
+	return v.Dense
+}
@@ -0,0 +1,201 @@
+package cui2vec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// maxDenseDims is the most dimensions of a dense matrix that is read, far more than any model has.
+const maxDenseDims = 1 << 20
+
+// writeUint32s writes each value as a little-endian four-byte sequence.
+func writeUint32s(w io.Writer, vals ...uint32) error {
+	b := make([]byte, 4*len(vals))
+	for i, val := range vals {
+		binary.LittleEndian.PutUint32(b[i*4:], val)
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readUint32s reads a little-endian four-byte sequence into each value.
+func readUint32s(r io.Reader, vals ...*uint32) error {
+	b := make([]byte, 4*len(vals))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	for i, val := range vals {
+		*val = binary.LittleEndian.Uint32(b[i*4:])
+	}
+	return nil
+}
+
+// readUint32Slice reads n little-endian four-byte sequences.
+func readUint32Slice(r io.Reader, n int) ([]uint32, error) {
+	b := make([]byte, 4*n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	vals := make([]uint32, n)
+	for i := range vals {
+		vals[i] = binary.LittleEndian.Uint32(b[i*4:])
+	}
+	return vals, nil
+}
+
+// writeFloat64s writes each value as a little-endian eight-byte sequence.
+func writeFloat64s(w io.Writer, x []float64) error {
+	b := make([]byte, 8*len(x))
+	for i, val := range x {
+		binary.LittleEndian.PutUint64(b[i*8:], math.Float64bits(val))
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readFloat64s reads len(x) little-endian eight-byte sequences into x.
+func readFloat64s(r io.Reader, x []float64) error {
+	b := make([]byte, 8*len(x))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	for i := range x {
+		x[i] = math.Float64frombits(binary.LittleEndian.Uint64(b[i*8:]))
+	}
+	return nil
+}
+
+// writeFloat32s writes each value as a little-endian four-byte sequence.
+func writeFloat32s(w io.Writer, x []float32) error {
+	b := make([]byte, 4*len(x))
+	for i, val := range x {
+		binary.LittleEndian.PutUint32(b[i*4:], math.Float32bits(val))
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// readFloat64Rows reads rows of dims little-endian eight-byte sequences. The rows are only allocated as they are
+// read, so that a corrupt number of rows does not allocate memory before an error is found.
+func readFloat64Rows(r io.Reader, rows, dims int) ([]float64, error) {
+	var data []float64
+	row := make([]float64, dims)
+	for i := 0; i < rows; i++ {
+		if err := readFloat64s(r, row); err != nil {
+			return nil, err
+		}
+		data = append(data, row...)
+	}
+	return data, nil
+}
+
+// readFloat32s reads len(x) little-endian four-byte sequences into x.
+func readFloat32s(r io.Reader, x []float32) error {
+	b := make([]byte, 4*len(x))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	for i := range x {
+		x[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[i*4:]))
+	}
+	return nil
+}
+
+// writeString writes a two-byte length followed by the bytes of the string.
+func writeString(w io.Writer, s string) error {
+	if len(s) > math.MaxUint16 {
+		return fmt.Errorf("%q is too long", s[:32])
+	}
+	b := make([]byte, 2+len(s))
+	binary.LittleEndian.PutUint16(b, uint16(len(s)))
+	copy(b[2:], s)
+	_, err := w.Write(b)
+	return err
+}
+
+// readString reads a string written by writeString.
+func readString(r io.Reader) (string, error) {
+	l := make([]byte, 2)
+	if _, err := io.ReadFull(r, l); err != nil {
+		return "", err
+	}
+	b := make([]byte, binary.LittleEndian.Uint16(l))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// writeCUIs writes a table of CUIs, where each CUI is written by writeString.
+func writeCUIs(w io.Writer, cuis []string) error {
+	for _, cui := range cuis {
+		if err := writeString(w, cui); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readCUIs reads a table of n CUIs written by writeCUIs. There are no more CUIs than there are CUI numbers, and the
+// table only grows as CUIs are read, so that a corrupt n does not allocate memory before an error is found.
+func readCUIs(r io.Reader, n int) ([]string, error) {
+	if n < 0 || n > maxCUI+1 {
+		return nil, fmt.Errorf("invalid number of cuis %d, expected at most %d", n, maxCUI+1)
+	}
+	var cuis []string
+	for i := 0; i < n; i++ {
+		cui, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		cuis = append(cuis, cui)
+	}
+	return cuis, nil
+}
+
+// writeDense writes the shape, CUIs, and rows of a dense matrix.
+func writeDense(w io.Writer, m *DenseMatrix) error {
+	if err := writeUint32s(w, uint32(m.Len()), uint32(m.Dims)); err != nil {
+		return err
+	}
+	if err := writeCUIs(w, m.CUIs); err != nil {
+		return err
+	}
+	for i := 0; i < m.Len(); i++ {
+		if err := writeFloat64s(w, m.Row(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readDense reads a dense matrix written by writeDense.
+func readDense(r io.Reader) (*DenseMatrix, error) {
+	var n, dims uint32
+	if err := readUint32s(r, &n, &dims); err != nil {
+		return nil, err
+	}
+	if dims > maxDenseDims {
+		return nil, fmt.Errorf("matrix has %d dimensions, expected at most %d", dims, maxDenseDims)
+	}
+	cuis, err := readCUIs(r, int(n))
+	if err != nil {
+		return nil, err
+	}
+	data, err := readFloat64Rows(r, len(cuis), int(dims))
+	if err != nil {
+		return nil, err
+	}
+	m := &DenseMatrix{
+		Data: data,
+		Dims: int(dims),
+		Rows: make(map[string]int, len(cuis)),
+		CUIs: cuis,
+	}
+	for i, cui := range cuis {
+		m.Rows[cui] = i
+	}
+	return m, nil
+}
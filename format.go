@@ -0,0 +1,175 @@
+package cui2vec
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// formatPeek is the number of bytes DetectFormat inspects.
+const formatPeek = 64 * 1024
+
+// Format describes the layout of an embeddings file, as detected by DetectFormat.
+type Format struct {
+	// Name is "csv" for cui2vec-style delimited files, "vec" for GloVe/fastText-style text files with a
+	// "count dims" header, or "word2vec" for the binary format of the word2vec C tool.
+	Name string
+	// Comma separates the CUI and the values of each line of text formats.
+	Comma rune
+	// Header is true when the first line of a text format is not a vector and should be skipped.
+	Header bool
+	// Quoted is true when CUIs are quoted.
+	Quoted bool
+	// Dims is the number of dimensions of each vector, or zero if it could not be determined.
+	Dims int
+}
+
+func (f Format) String() string {
+	var details []string
+	if f.Name != "word2vec" {
+		switch f.Comma {
+		case '\t':
+			details = append(details, "tab-separated")
+		case ' ':
+			details = append(details, "space-separated")
+		default:
+			details = append(details, fmt.Sprintf("%q-separated", f.Comma))
+		}
+		if f.Header {
+			details = append(details, "header")
+		}
+		if f.Quoted {
+			details = append(details, "quoted cuis")
+		}
+	}
+	if f.Dims > 0 {
+		details = append(details, fmt.Sprintf("%d dims", f.Dims))
+	}
+	return fmt.Sprintf("%s (%s)", f.Name, strings.Join(details, ", "))
+}
+
+// DetectFormat inspects the start of an embeddings file to determine its format, without consuming any of it.
+// It recognises the cui2vec csv file with or without its header row of column names, quoted or unquoted CUIs,
+// space- or tab-separated .vec files with a "count dims" header line, and word2vec binary files.
+func DetectFormat(br *bufio.Reader) (Format, error) {
+	b, err := br.Peek(formatPeek)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return Format{}, err
+	}
+	if len(b) == 0 {
+		return Format{}, io.ErrUnexpectedEOF
+	}
+
+	lines := bytes.SplitN(b, []byte("\n"), 3)
+	first := strings.TrimRight(string(lines[0]), " \t\r")
+
+	// A header of two integers is the number of vectors and the dimensions.
+	if fields := strings.Fields(first); len(fields) == 2 && isInt(fields[0]) && isInt(fields[1]) {
+		dims, _ := strconv.Atoi(fields[1])
+		rest := b[len(lines[0]):]
+		if !isText(rest) {
+			return Format{Name: "word2vec", Dims: dims}, nil
+		}
+		f := Format{Name: "vec", Comma: ' ', Header: true, Dims: dims}
+		if len(lines) > 1 && strings.Contains(string(lines[1]), "\t") {
+			f.Comma = '\t'
+		}
+		if len(lines) > 1 {
+			f.Quoted = strings.HasPrefix(string(lines[1]), `"`)
+		}
+		return f, nil
+	}
+
+	// Otherwise the file is delimited, and the first line may be a row of column names.
+	data := first
+	if len(lines) > 1 && len(strings.TrimSpace(string(lines[1]))) > 0 {
+		data = strings.TrimRight(string(lines[1]), " \t\r")
+	}
+	f := Format{Name: "csv", Comma: ','}
+	for _, c := range []rune{',', '\t', ';', ' '} {
+		if strings.ContainsRune(data, c) {
+			f.Comma = c
+			break
+		}
+	}
+	f.Quoted = strings.HasPrefix(data, `"`)
+
+	header := strings.Split(first, string(f.Comma))
+	for _, field := range header[1:] {
+		if !isFloat(strings.Trim(field, `"`)) {
+			f.Header = true
+			break
+		}
+	}
+	if data != first || !f.Header {
+		f.Dims = len(strings.Split(data, string(f.Comma))) - 1
+	}
+	return f, nil
+}
+
+// isInt reports whether s is an integer.
+func isInt(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+// isFloat reports whether s is a floating point number.
+func isFloat(s string) bool {
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil
+}
+
+// isText reports whether b looks like text rather than binary data.
+func isText(b []byte) bool {
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		if r == utf8.RuneError && size == 1 && len(b) >= utf8.UTFMax {
+			return false
+		}
+		if r < 0x20 && r != '\n' && r != '\r' && r != '\t' {
+			return false
+		}
+		b = b[size:]
+	}
+	return true
+}
+
+// LoadDetected detects the format of a model with DetectFormat and loads it into memory, replacing the SkipFirst
+// and Comma settings of the embeddings with those that were detected. Vectors of csv models keep the zero in place of
+// the CUI column unless DropCUIColumn is set, but vectors of vec models, whose header gives their dimensions, never
+// have it.
+func (v *UncompressedEmbeddings) LoadDetected(r io.Reader) (Format, error) {
+	br := bufio.NewReaderSize(r, formatPeek)
+	f, err := DetectFormat(br)
+	if err != nil {
+		return f, err
+	}
+	if f.Name == "word2vec" {
+		return f, v.LoadWord2Vec(br)
+	}
+	v.SkipFirst = f.Header
+	v.Comma = f.Comma
+	if f.Name == "vec" {
+		v.DropCUIColumn = true
+	}
+	return f, v.LoadModel(br)
+}
+
+// LoadEmbeddings loads a model of any format recognised by DetectFormat, and returns the format it detected.
+// Compressed models are decompressed first.
+func LoadEmbeddings(r io.Reader) (*UncompressedEmbeddings, Format, error) {
+	v := &UncompressedEmbeddings{
+		Embeddings: make(map[string][]float64),
+	}
+	var f Format
+	err := decompressed(r, func(r io.Reader) error {
+		var err error
+		f, err = v.LoadDetected(r)
+		return err
+	})
+	return v, f, err
+}
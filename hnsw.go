@@ -0,0 +1,495 @@
+package cui2vec
+
+import (
+	"bufio"
+	"container/heap"
+	"errors"
+	"fmt"
+	"gonum.org/v1/gonum/floats"
+	"io"
+	"math"
+	"math/rand"
+	"sync"
+)
+
+const (
+	// DefaultHNSWM is the default number of links per node in an HNSWIndex.
+	DefaultHNSWM = 16
+	// DefaultHNSWEfConstruction is the default size of the candidate list used to build an HNSWIndex.
+	DefaultHNSWEfConstruction = 200
+	// DefaultHNSWEfSearch is the default size of the candidate list used to search an HNSWIndex.
+	DefaultHNSWEfSearch = 64
+
+	hnswMagic   = "HNSW"
+	hnswVersion = 1
+	// hnswMaxLevel is the highest layer of any index. Levels are drawn as -ln(u)/ln(M) for u of at least 2^-53, so
+	// no node of an index with M of 2 or more is above layer 53.
+	hnswMaxLevel = 64
+)
+
+// HNSWIndex is an approximate nearest neighbour index over cui2vec embeddings that answers top-k queries without
+// comparing every vector. It is a Hierarchical Navigable Small World graph, as described in:
+//
+//	Malkov, Yashunin (2018) Efficient and robust approximate nearest neighbor search using Hierarchical Navigable
+//	Small World graphs. IEEE Transactions on Pattern Analysis and Machine Intelligence.
+//
+// Similarity is Cosine similarity; the index holds its own L2-normalised copy of the vectors, so it can be written to
+// and loaded from disk without the original embeddings.
+//
+// M is the number of links per node on each layer (2M on the bottom layer), and EfConstruction is the size of the
+// candidate list used while building; both are fixed once the index is built. EfSearch is the size of the candidate
+// list used while searching, and can be tuned at any time: larger values trade speed for recall. K is the number of
+// CUIs returned by Similar.
+type HNSWIndex struct {
+	M              int
+	EfConstruction int
+	EfSearch       int
+	K              int
+
+	vectors  *DenseMatrix
+	links    [][][]int32 // node -> layer -> neighbours
+	entry    int32
+	maxLevel int
+	visited  sync.Pool
+}
+
+// hnswCandidate is a node in the graph and its similarity to a query.
+type hnswCandidate struct {
+	node int32
+	sim  float64
+}
+
+// hnswQueue is a heap of candidates. When max is true, the most similar candidate is at the top of the heap.
+type hnswQueue struct {
+	items []hnswCandidate
+	max   bool
+}
+
+func (q *hnswQueue) Len() int {
+	return len(q.items)
+}
+
+func (q *hnswQueue) Less(i, j int) bool {
+	if q.max {
+		return q.items[i].sim > q.items[j].sim
+	}
+	return q.items[i].sim < q.items[j].sim
+}
+
+func (q *hnswQueue) Swap(i, j int) {
+	q.items[i], q.items[j] = q.items[j], q.items[i]
+}
+
+func (q *hnswQueue) Push(x interface{}) {
+	q.items = append(q.items, x.(hnswCandidate))
+}
+
+func (q *hnswQueue) Pop() interface{} {
+	c := q.items[len(q.items)-1]
+	q.items = q.items[:len(q.items)-1]
+	return c
+}
+
+// visitedSet marks the nodes visited by a search. Rather than clearing the marks between searches, the generation is
+// incremented.
+type visitedSet struct {
+	marks      []uint32
+	generation uint32
+}
+
+func (s *visitedSet) reset() {
+	s.generation++
+	if s.generation == 0 {
+		for i := range s.marks {
+			s.marks[i] = 0
+		}
+		s.generation = 1
+	}
+}
+
+// visit marks a node as visited, returning false if it was already visited.
+func (s *visitedSet) visit(node int32) bool {
+	if s.marks[node] == s.generation {
+		return false
+	}
+	s.marks[node] = s.generation
+	return true
+}
+
+// NewHNSWIndex builds an HNSW graph over the vectors of the embeddings, with m links per node and a candidate list
+// of efConstruction while building. Values <= 0 use DefaultHNSWM and DefaultHNSWEfConstruction.
+func NewHNSWIndex(e *UncompressedEmbeddings, m, efConstruction int) (*HNSWIndex, error) {
+	if m <= 0 {
+		m = DefaultHNSWM
+	}
+	if efConstruction <= 0 {
+		efConstruction = DefaultHNSWEfConstruction
+	}
+
+	vectors, err := normalisedMatrix(e)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &HNSWIndex{
+		M:              m,
+		EfConstruction: efConstruction,
+		EfSearch:       DefaultHNSWEfSearch,
+		vectors:        vectors,
+		links:          make([][][]int32, vectors.Len()),
+		entry:          -1,
+	}
+	h.init()
+
+	rng := rand.New(rand.NewSource(1))
+	levelMult := 1 / math.Log(float64(m))
+	for i := 0; i < vectors.Len(); i++ {
+		level := int(-math.Log(1-rng.Float64()) * levelMult)
+		h.insert(int32(i), level)
+	}
+	return h, nil
+}
+
+// LoadHNSWIndex reads an index written by WriteModel, decompressing it if necessary.
+func LoadHNSWIndex(r io.Reader) (*HNSWIndex, error) {
+	h := new(HNSWIndex)
+	err := decompressed(r, h.LoadModel)
+	return h, err
+}
+
+// normalisedMatrix copies the values of the vectors of the embeddings into a dense matrix of L2-normalised rows.
+func normalisedMatrix(e *UncompressedEmbeddings) (*DenseMatrix, error) {
+	m, err := e.valueMatrix()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < m.Len(); i++ {
+		if n := norm(m.Row(i), 2); n > 0 {
+			floats.Scale(1/n, m.Row(i))
+		}
+	}
+	return m, nil
+}
+
+// init prepares the pool of visited sets used by searches.
+func (h *HNSWIndex) init() {
+	n := h.vectors.Len()
+	h.visited.New = func() interface{} {
+		return &visitedSet{marks: make([]uint32, n)}
+	}
+}
+
+func (h *HNSWIndex) sim(q []float64, node int32) float64 {
+	return floats.Dot(q, h.vectors.Row(int(node)))
+}
+
+// maxLinks is the maximum number of links a node may have on a layer.
+func (h *HNSWIndex) maxLinks(layer int) int {
+	if layer == 0 {
+		return 2 * h.M
+	}
+	return h.M
+}
+
+// insert adds a node to the graph with links on every layer up to level.
+func (h *HNSWIndex) insert(node int32, level int) {
+	h.links[node] = make([][]int32, level+1)
+	if h.entry < 0 {
+		h.entry = node
+		h.maxLevel = level
+		return
+	}
+
+	q := h.vectors.Row(int(node))
+	ep := []hnswCandidate{{node: h.entry, sim: h.sim(q, h.entry)}}
+
+	// Greedily descend through the layers above the level of the node.
+	for layer := h.maxLevel; layer > level; layer-- {
+		ep = h.searchLayer(q, ep, 1, layer)
+	}
+
+	top := level
+	if top > h.maxLevel {
+		top = h.maxLevel
+	}
+	for layer := top; layer >= 0; layer-- {
+		candidates := h.searchLayer(q, ep, h.EfConstruction, layer)
+		neighbours := h.selectNeighbours(candidates, h.M)
+		h.links[node][layer] = neighbours
+
+		// Link the neighbours back to the node, shrinking their links if there are too many.
+		for _, n := range neighbours {
+			links := append(h.links[n][layer], node)
+			if len(links) > h.maxLinks(layer) {
+				nq := h.vectors.Row(int(n))
+				cs := make([]hnswCandidate, len(links))
+				for i, l := range links {
+					cs[i] = hnswCandidate{node: l, sim: h.sim(nq, l)}
+				}
+				links = h.selectNeighbours(cs, h.maxLinks(layer))
+			}
+			h.links[n][layer] = links
+		}
+		ep = candidates
+	}
+
+	if level > h.maxLevel {
+		h.maxLevel = level
+		h.entry = node
+	}
+}
+
+// selectNeighbours chooses at most m of the candidates to link to using the heuristic of Malkov and Yashunin: a
+// candidate is preferred if it is more similar to the query than to any neighbour already chosen, which keeps links
+// spread across clusters. Remaining slots are filled with the most similar candidates that were passed over.
+func (h *HNSWIndex) selectNeighbours(candidates []hnswCandidate, m int) []int32 {
+	sorted := make([]hnswCandidate, len(candidates))
+	copy(sorted, candidates)
+	q := &hnswQueue{items: sorted, max: true}
+	heap.Init(q)
+
+	selected := make([]int32, 0, m)
+	var pruned []int32
+	for q.Len() > 0 && len(selected) < m {
+		c := heap.Pop(q).(hnswCandidate)
+		cv := h.vectors.Row(int(c.node))
+		good := true
+		for _, s := range selected {
+			if h.sim(cv, s) > c.sim {
+				good = false
+				break
+			}
+		}
+		if good {
+			selected = append(selected, c.node)
+		} else {
+			pruned = append(pruned, c.node)
+		}
+	}
+	for i := 0; i < len(pruned) && len(selected) < m; i++ {
+		selected = append(selected, pruned[i])
+	}
+	return selected
+}
+
+// searchLayer finds the ef nodes on a layer most similar to q, starting from the entry points, sorted from most to
+// least similar.
+func (h *HNSWIndex) searchLayer(q []float64, entry []hnswCandidate, ef int, layer int) []hnswCandidate {
+	visited := h.visited.Get().(*visitedSet)
+	defer h.visited.Put(visited)
+	visited.reset()
+
+	candidates := &hnswQueue{max: true}
+	results := &hnswQueue{}
+	for _, e := range entry {
+		visited.visit(e.node)
+		heap.Push(candidates, e)
+		heap.Push(results, e)
+		if results.Len() > ef {
+			heap.Pop(results)
+		}
+	}
+
+	for candidates.Len() > 0 {
+		c := heap.Pop(candidates).(hnswCandidate)
+		if results.Len() >= ef && c.sim < results.items[0].sim {
+			break
+		}
+		if layer >= len(h.links[c.node]) {
+			continue
+		}
+		for _, n := range h.links[c.node][layer] {
+			if !visited.visit(n) {
+				continue
+			}
+			sim := h.sim(q, n)
+			if results.Len() < ef || sim > results.items[0].sim {
+				heap.Push(candidates, hnswCandidate{node: n, sim: sim})
+				heap.Push(results, hnswCandidate{node: n, sim: sim})
+				if results.Len() > ef {
+					heap.Pop(results)
+				}
+			}
+		}
+	}
+
+	sorted := make([]hnswCandidate, results.Len())
+	for i := len(sorted) - 1; i >= 0; i-- {
+		sorted[i] = heap.Pop(results).(hnswCandidate)
+	}
+	return sorted
+}
+
+// search finds approximately the k nodes most similar to q, excluding the node skip.
+func (h *HNSWIndex) search(q []float64, k int, skip int32) []Concept {
+	if h.entry < 0 {
+		return []Concept{}
+	}
+	ef := h.EfSearch
+	if ef < k+1 {
+		ef = k + 1
+	}
+
+	ep := []hnswCandidate{{node: h.entry, sim: h.sim(q, h.entry)}}
+	for layer := h.maxLevel; layer > 0; layer-- {
+		ep = h.searchLayer(q, ep, 1, layer)
+	}
+	candidates := h.searchLayer(q, ep, ef, 0)
+
+	concepts := make([]Concept, 0, k)
+	for _, c := range candidates {
+		if c.node == skip {
+			continue
+		}
+		if len(concepts) == k {
+			break
+		}
+		concepts = append(concepts, Concept{CUI: h.vectors.CUIs[c.node], Value: c.sim})
+	}
+	return concepts
+}
+
+// SimilarK approximates the k CUIs most similar to an input CUI, sorted by Cosine similarity.
+// Unknown CUIs have no similar CUIs.
+func (h *HNSWIndex) SimilarK(cui string, k int) ([]Concept, error) {
+	node, ok := h.vectors.Rows[cui]
+	if !ok || k <= 0 {
+		return []Concept{}, nil
+	}
+	return h.search(h.vectors.Row(node), k, int32(node)), nil
+}
+
+// SimilarVector approximates the k CUIs most similar to a vector, sorted by Cosine similarity.
+func (h *HNSWIndex) SimilarVector(vec []float64, k int) ([]Concept, error) {
+	if len(vec) != h.vectors.Dims {
+		return nil, fmt.Errorf("vector has %d dimensions, expected %d", len(vec), h.vectors.Dims)
+	}
+	if k <= 0 {
+		return []Concept{}, nil
+	}
+	q := make([]float64, len(vec))
+	copy(q, vec)
+	if n := norm(q, 2); n > 0 {
+		floats.Scale(1/n, q)
+	}
+	return h.search(q, k, -1), nil
+}
+
+// Similar approximates the K CUIs most similar to an input CUI, or 20 if K is not set.
+func (h *HNSWIndex) Similar(cui string) ([]Concept, error) {
+	k := h.K
+	if k <= 0 {
+		k = 20
+	}
+	return h.SimilarK(cui, k)
+}
+
+// WriteModel writes the index, including its vectors, to disk. The file begins with the magic bytes "HNSW" and a
+// version, followed by the parameters of the index, the vectors, and then the links of each node, layer by layer.
+func (h *HNSWIndex) WriteModel(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(hnswMagic); err != nil {
+		return err
+	}
+	err := writeUint32s(bw, hnswVersion, uint32(h.M), uint32(h.EfConstruction), uint32(h.EfSearch),
+		uint32(h.entry), uint32(h.maxLevel))
+	if err != nil {
+		return err
+	}
+	if err := writeDense(bw, h.vectors); err != nil {
+		return err
+	}
+	for _, layers := range h.links {
+		if err := writeUint32s(bw, uint32(len(layers))); err != nil {
+			return err
+		}
+		for _, links := range layers {
+			vals := make([]uint32, len(links)+1)
+			vals[0] = uint32(len(links))
+			for i, l := range links {
+				vals[i+1] = uint32(l)
+			}
+			if err := writeUint32s(bw, vals...); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// LoadModel reads an index written by WriteModel.
+func (h *HNSWIndex) LoadModel(r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(hnswMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return err
+	}
+	if string(magic) != hnswMagic {
+		return errors.New("not an hnsw index")
+	}
+
+	var version, m, efConstruction, efSearch, entry, maxLevel uint32
+	if err := readUint32s(br, &version, &m, &efConstruction, &efSearch, &entry, &maxLevel); err != nil {
+		return err
+	}
+	if version != hnswVersion {
+		return fmt.Errorf("unsupported hnsw index version %d", version)
+	}
+	if maxLevel > hnswMaxLevel {
+		return fmt.Errorf("index has %d layers, expected at most %d", maxLevel+1, hnswMaxLevel+1)
+	}
+
+	vectors, err := readDense(br)
+	if err != nil {
+		return err
+	}
+	if vectors.Len() > 0 && int64(entry) >= int64(vectors.Len()) {
+		return fmt.Errorf("entry point %d is not one of the %d nodes", entry, vectors.Len())
+	}
+
+	links := make([][][]int32, vectors.Len())
+	for node := range links {
+		var levels uint32
+		if err := readUint32s(br, &levels); err != nil {
+			return err
+		}
+		if levels > maxLevel+1 {
+			return fmt.Errorf("node %d has %d layers, expected at most %d", node, levels, maxLevel+1)
+		}
+		links[node] = make([][]int32, levels)
+		for layer := range links[node] {
+			var n uint32
+			if err := readUint32s(br, &n); err != nil {
+				return err
+			}
+			if int(n) > len(links) {
+				return fmt.Errorf("node %d has %d links, expected at most %d", node, n, len(links))
+			}
+			raw, err := readUint32Slice(br, int(n))
+			if err != nil {
+				return err
+			}
+			links[node][layer] = make([]int32, n)
+			for i, l := range raw {
+				if int(l) >= len(links) {
+					return fmt.Errorf("node %d links to unknown node %d", node, l)
+				}
+				links[node][layer][i] = int32(l)
+			}
+		}
+	}
+
+	// Searches descend from the top layer of the entry point, so it must be on every layer.
+	if vectors.Len() > 0 && len(links[entry]) != int(maxLevel)+1 {
+		return fmt.Errorf("entry point %d has %d layers, expected %d", entry, len(links[entry]), maxLevel+1)
+	}
+
+	h.M, h.EfConstruction, h.EfSearch = int(m), int(efConstruction), int(efSearch)
+	h.entry, h.maxLevel = int32(entry), int(maxLevel)
+	h.vectors, h.links = vectors, links
+	if vectors.Len() == 0 {
+		h.entry = -1
+	}
+	h.init()
+	return nil
+}
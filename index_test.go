@@ -0,0 +1,238 @@
+package cui2vec_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/hscells/cui2vec"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestHNSWIndex(t *testing.T) {
+	e, err := cui2vec.NewUncompressedEmbeddings(strings.NewReader(syntheticModel(2000, 16)), false, ',')
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := cui2vec.NewHNSWIndex(e, 8, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.EfSearch = 100
+
+	var buf bytes.Buffer
+	if err := h.WriteModel(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := cui2vec.LoadHNSWIndex(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.M != 8 || loaded.EfSearch != 100 {
+		t.Fatalf("unexpected parameters after loading: %d %d", loaded.M, loaded.EfSearch)
+	}
+
+	var found, total int
+	for i := 1; i <= 100; i++ {
+		cui := cui2vec.Int2CUI(i)
+		exact, err := e.SimilarK(cui, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		approx, err := loaded.SimilarK(cui, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		relevant := make(map[string]bool)
+		for _, c := range exact {
+			relevant[c.CUI] = true
+		}
+		for _, c := range approx {
+			if c.CUI == cui {
+				t.Fatalf("%s is similar to itself", cui)
+			}
+			if relevant[c.CUI] {
+				found++
+			}
+		}
+		total += len(exact)
+	}
+	if recall := float64(found) / float64(total); recall < 0.9 {
+		t.Errorf("expected recall@10 of at least 0.9, got %f", recall)
+	}
+
+	// The index holds the values of the vectors, without the zero in place of the CUI column.
+	for _, k := range []int{0, -1} {
+		concepts, err := loaded.SimilarVector(e.Embeddings["C0000001"][1:], k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(concepts) != 0 {
+			t.Errorf("expected no concepts for k of %d, got %d", k, len(concepts))
+		}
+	}
+
+	// The entry point and top layer follow the magic bytes, version and three parameters.
+	var model bytes.Buffer
+	if err := h.WriteModel(&model); err != nil {
+		t.Fatal(err)
+	}
+	b := model.Bytes()
+	maxLevel := binary.LittleEndian.Uint32(b[24:])
+	tests := []struct {
+		name    string
+		corrupt func(b []byte) []byte
+	}{
+		{"truncated", func(b []byte) []byte { return b[:len(b)/2] }},
+		{"entry", func(b []byte) []byte { binary.LittleEndian.PutUint32(b[20:], 2000); return b }},
+		{"top layer", func(b []byte) []byte { binary.LittleEndian.PutUint32(b[24:], maxLevel+1); return b }},
+		{"too many layers", func(b []byte) []byte { binary.LittleEndian.PutUint32(b[24:], 1<<31); return b }},
+		{"too many cuis", func(b []byte) []byte { binary.LittleEndian.PutUint32(b[28:], 1<<31); return b }},
+		{"too many dimensions", func(b []byte) []byte { binary.LittleEndian.PutUint32(b[32:], 1<<31); return b }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			corrupt := test.corrupt(append([]byte(nil), b...))
+			if _, err := cui2vec.LoadHNSWIndex(bytes.NewReader(corrupt)); err == nil {
+				t.Error("expected an error for a corrupt index")
+			}
+		})
+	}
+
+	// The vectors of a truncated index are only allocated as they are read.
+	truncated := append([]byte(nil), b[:36]...)
+	binary.LittleEndian.PutUint32(truncated[28:], 9999999)
+	if n := allocated(func() { cui2vec.LoadHNSWIndex(bytes.NewReader(truncated)) }); n > 1<<20 {
+		t.Errorf("expected a truncated index to allocate little memory, allocated %d bytes", n)
+	}
+}
+
+// allocated is the number of bytes allocated by fn.
+func allocated(fn func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	fn()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func TestLSHIndex(t *testing.T) {
+	e, err := cui2vec.NewUncompressedEmbeddings(strings.NewReader(syntheticModel(2000, 16)), false, ',')
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := cui2vec.NewLSHIndex(e, 16, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := l.WriteModel(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := cui2vec.LoadLSHIndex(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Tables != 16 || loaded.Bits != 8 {
+		t.Fatalf("unexpected parameters after loading: %d %d", loaded.Tables, loaded.Bits)
+	}
+
+	cuis := make([]string, 100)
+	for i := range cuis {
+		cuis[i] = cui2vec.Int2CUI(i + 1)
+	}
+	recall, err := cui2vec.RecallAtK(loaded, e, cuis, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recall < 0.8 {
+		t.Errorf("expected recall@10 of at least 0.8, got %f", recall)
+	}
+	concepts, err := loaded.SimilarK(cuis[0], 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range concepts {
+		if c.CUI == cuis[0] {
+			t.Fatalf("%s is similar to itself", cuis[0])
+		}
+	}
+
+	// The tables and bits follow the magic bytes and version, and the hyperplanes follow the vectors.
+	var model bytes.Buffer
+	if err := l.WriteModel(&model); err != nil {
+		t.Fatal(err)
+	}
+	data := model.Bytes()
+	for name, tables := range map[string]uint32{"no tables": 0, "too many tables": 1 << 31} {
+		corrupt := append([]byte(nil), data...)
+		binary.LittleEndian.PutUint32(corrupt[8:], tables)
+		if _, err := cui2vec.LoadLSHIndex(bytes.NewReader(corrupt)); err == nil {
+			t.Errorf("%s: expected an error for a corrupt index", name)
+		}
+	}
+	truncated := append([]byte(nil), data[:len(data)-16*8*16*8]...)
+	binary.LittleEndian.PutUint32(truncated[8:], 1<<16)
+	if n := allocated(func() { cui2vec.LoadLSHIndex(bytes.NewReader(truncated)) }); n > 16<<20 {
+		t.Errorf("expected a truncated index to allocate little memory, allocated %d bytes", n)
+	}
+}
+
+func BenchmarkHNSWSimilarK(b *testing.B) {
+	e, err := cui2vec.NewUncompressedEmbeddings(strings.NewReader(syntheticModel(5000, 500)), false, ',')
+	if err != nil {
+		b.Fatal(err)
+	}
+	h, err := cui2vec.NewHNSWIndex(e, cui2vec.DefaultHNSWM, 100)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := h.SimilarK(cui2vec.Int2CUI(i%5000+1), 10); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestPQEmbeddings(t *testing.T) {
+	e := loadValues(t, syntheticModel(2000, 16))
+	p, err := cui2vec.TrainPQEmbeddings(e, 8, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := p.WriteModel(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() > 2000*(8+10)+8*256*2*4+32 {
+		t.Errorf("compressed model is too large: %d bytes", buf.Len())
+	}
+	loaded, err := cui2vec.NewPQEmbeddings(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vec, ok := loaded.Vector("C0000001")
+	if !ok {
+		t.Fatal("expected a vector for C0000001")
+	}
+	if sim, _ := cui2vec.Cosine(vec, e.Embeddings["C0000001"]); sim < 0.9 {
+		t.Errorf("expected the reconstruction to be close to the vector, got cosine %f", sim)
+	}
+
+	cuis := make([]string, 100)
+	for i := range cuis {
+		cuis[i] = cui2vec.Int2CUI(i + 1)
+	}
+	recall, err := cui2vec.RecallAtK(loaded, e, cuis, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recall < 0.5 {
+		t.Errorf("expected recall@10 of at least 0.5, got %f", recall)
+	}
+}
@@ -0,0 +1,171 @@
+package cui2vec
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Problem is a kind of inconsistency that Inspect finds in a pre-computed matrix.
+type Problem int
+
+const (
+	// ProblemColumns is a row that is longer than `Cols`, or that does not hold a whole number of concepts.
+	ProblemColumns Problem = iota
+	// ProblemInvalidCUI is a neighbour whose number is not that of a CUI.
+	ProblemInvalidCUI
+	// ProblemSelfReference is a CUI that is listed as its own neighbour.
+	ProblemSelfReference
+	// ProblemDuplicate is a CUI that is listed more than once as the neighbour of a CUI.
+	ProblemDuplicate
+	// ProblemPadding is padding that is followed by a neighbour, or that has a score.
+	ProblemPadding
+	// ProblemScore is a score that is not a number.
+	ProblemScore
+	// ProblemOrder is a neighbour that scores higher than the neighbour before it.
+	ProblemOrder
+	// ProblemRows is a matrix that does not hold the number of rows that were expected, or a shard that holds the row
+	// of a CUI of another shard.
+	ProblemRows
+)
+
+func (p Problem) String() string {
+	switch p {
+	case ProblemColumns:
+		return "inconsistent columns"
+	case ProblemInvalidCUI:
+		return "invalid cuis"
+	case ProblemSelfReference:
+		return "self-references"
+	case ProblemDuplicate:
+		return "duplicate neighbours"
+	case ProblemPadding:
+		return "invalid padding"
+	case ProblemScore:
+		return "invalid scores"
+	case ProblemOrder:
+		return "out of order scores"
+	case ProblemRows:
+		return "missing or misplaced rows"
+	}
+	return fmt.Sprintf("Problem(%d)", int(p))
+}
+
+// Inspection describes the rows of a pre-computed matrix, and counts the problems found in them. The first few
+// problems are described in Examples.
+type Inspection struct {
+	// Rows is the size of the matrix, Populated is the number of rows that were computed, and Empty is the number of
+	// those that have no neighbours.
+	Rows      int
+	Populated int
+	Empty     int
+	// Neighbours is the number of neighbours in every row, and Padded is the number of rows padded with zeros.
+	Neighbours int
+	Padded     int
+
+	Problems map[Problem]int
+	Examples []string
+}
+
+// Corrupt reports whether any problems were found.
+func (i Inspection) Corrupt() bool {
+	return len(i.Problems) > 0
+}
+
+// Kinds returns the kinds of problems that were found, in order.
+func (i Inspection) Kinds() []Problem {
+	kinds := make([]Problem, 0, len(i.Problems))
+	for p := range i.Problems {
+		kinds = append(kinds, p)
+	}
+	sort.Slice(kinds, func(a, b int) bool {
+		return kinds[a] < kinds[b]
+	})
+	return kinds
+}
+
+// Inspect checks the consistency of every row of the matrix: that each is no wider than `Cols` and holds whole
+// concepts, that every neighbour is a valid CUI other than the CUI of the row and is listed once, that padding is only
+// at the end of a row, and that scores are numbers that never increase along a row. It also checks that the matrix
+// holds the rows that were Expected, and only those of its Shard. Scores are the softmax scores, which are stored by
+// every encoding. At most examples problems are described.
+func (v *PrecomputedEmbeddings) Inspect(examples int) Inspection {
+	in := Inspection{Rows: len(v.Matrix), Problems: make(map[Problem]int)}
+	report := func(p Problem, format string, args ...interface{}) {
+		in.Problems[p]++
+		if len(in.Examples) < examples {
+			in.Examples = append(in.Examples, fmt.Sprintf(format, args...))
+		}
+	}
+
+	encoding := v.encoding()
+	stride := encoding.Stride()
+
+	for i, row := range v.Matrix {
+		if row == nil {
+			continue
+		}
+		cui := Int2CUI(i)
+		in.Populated++
+		if len(row) == 0 {
+			in.Empty++
+		}
+		if len(row) > v.Cols || len(row)%stride != 0 {
+			report(ProblemColumns, "%s has %d columns, expected at most %d in multiples of %d", cui, len(row), v.Cols, stride)
+		}
+		if v.Shards > 0 && i%v.Shards+1 != v.Shard {
+			report(ProblemRows, "%s is in shard %d, but belongs to shard %d", cui, v.Shard, i%v.Shards+1)
+		}
+
+		seen := make(map[int]bool)
+		padded := false
+		previous := math.Inf(1)
+		for j := 0; j+stride <= len(row); j += stride {
+			n := j/stride + 1
+			c := row[j]
+			if c == 0 {
+				padded = true
+				for _, x := range row[j+1 : j+stride] {
+					if x != 0 {
+						report(ProblemPadding, "%s has a score in the padding of neighbour %d", cui, n)
+						break
+					}
+				}
+				continue
+			}
+			if padded {
+				report(ProblemPadding, "%s has neighbour %d after padding", cui, n)
+			}
+			in.Neighbours++
+
+			switch {
+			case c < 0 || c > maxCUI:
+				report(ProblemInvalidCUI, "%s has neighbour %d with the invalid cui number %d", cui, n, c)
+			case c == i:
+				report(ProblemSelfReference, "%s lists itself as neighbour %d", cui, n)
+			case seen[c]:
+				report(ProblemDuplicate, "%s lists %s more than once", cui, Int2CUI(c))
+			}
+			seen[c] = true
+
+			// Only softmax scores are checked, as raw scores are unknown for migrated matrices.
+			score := v.score(row[j:j+stride], ScoreSoftmax)
+			if math.IsNaN(score) || math.IsInf(score, 0) {
+				report(ProblemScore, "%s has the score %v for neighbour %d", cui, score, n)
+				continue
+			}
+			if score > previous {
+				report(ProblemOrder, "%s scores neighbour %d higher than neighbour %d (%v > %v)", cui, n, n-1, score, previous)
+			}
+			previous = score
+		}
+		if padded {
+			in.Padded++
+		}
+	}
+
+	if v.Expected > 0 && in.Populated != v.Expected {
+		report(ProblemRows, "%d rows were computed, but %d were expected", in.Populated, v.Expected)
+	}
+	return in
+}
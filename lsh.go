@@ -0,0 +1,273 @@
+package cui2vec
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"gonum.org/v1/gonum/floats"
+	"gonum.org/v1/gonum/mat"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+const (
+	// DefaultLSHTables is the default number of hash tables in an LSHIndex.
+	DefaultLSHTables = 8
+	// DefaultLSHBits is the default number of hyperplanes per hash table in an LSHIndex.
+	DefaultLSHBits = 14
+	// maxLSHTables is the most hash tables of an index that is loaded, far more than any index has.
+	maxLSHTables = 1 << 16
+	// DefaultLSHProbes is the default number of additional buckets probed per hash table in an LSHIndex.
+	DefaultLSHProbes = 4
+
+	lshMagic   = "LSHI"
+	lshVersion = 1
+	lshBlock   = 4096
+)
+
+// LSHIndex is an approximate nearest neighbour index over cui2vec embeddings based on locality-sensitive hashing
+// with signed random projections: each of Tables hash tables assigns a vector to a bucket by which side of Bits
+// random hyperplanes it lies on, so vectors with a high Cosine similarity are likely to share a bucket.
+// See: Charikar (2002) Similarity estimation techniques from rounding algorithms.
+//
+// A query collects the vectors in its bucket of every table, plus Probes neighbouring buckets per table that differ
+// from its own by the bit of the hyperplane closest to the query (a simple form of multi-probe LSH), and then ranks
+// the candidates by their exact Cosine similarity. More tables and probes increase recall; more bits make buckets
+// smaller and queries faster. The index is cheaper to build and hold than an HNSWIndex. K is the number of CUIs
+// returned by Similar.
+type LSHIndex struct {
+	Tables int
+	Bits   int
+	Probes int
+	K      int
+
+	vectors *DenseMatrix
+	planes  *mat.Dense // (Tables*Bits) x Dims
+	buckets []map[uint64][]int32
+	visited sync.Pool
+}
+
+// NewLSHIndex hashes the vectors of the embeddings into the given number of tables with bits hyperplanes each.
+// Values <= 0 use DefaultLSHTables and DefaultLSHBits. There may be at most 64 bits per table.
+func NewLSHIndex(e *UncompressedEmbeddings, tables, bits int) (*LSHIndex, error) {
+	if tables <= 0 {
+		tables = DefaultLSHTables
+	}
+	if bits <= 0 {
+		bits = DefaultLSHBits
+	}
+	if bits > 64 {
+		return nil, fmt.Errorf("at most 64 bits per table are supported, got %d", bits)
+	}
+
+	vectors, err := normalisedMatrix(e)
+	if err != nil {
+		return nil, err
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	planes := make([]float64, tables*bits*vectors.Dims)
+	for i := range planes {
+		planes[i] = rng.NormFloat64()
+	}
+
+	l := &LSHIndex{
+		Tables:  tables,
+		Bits:    bits,
+		Probes:  DefaultLSHProbes,
+		vectors: vectors,
+	}
+	if vectors.Dims > 0 {
+		l.planes = mat.NewDense(tables*bits, vectors.Dims, planes)
+	}
+	l.index()
+	return l, nil
+}
+
+// LoadLSHIndex reads an index written by WriteModel, decompressing it if necessary.
+func LoadLSHIndex(r io.Reader) (*LSHIndex, error) {
+	l := new(LSHIndex)
+	err := decompressed(r, l.LoadModel)
+	return l, err
+}
+
+// index hashes every vector into the buckets of each table.
+func (l *LSHIndex) index() {
+	l.buckets = make([]map[uint64][]int32, l.Tables)
+	for t := range l.buckets {
+		l.buckets[t] = make(map[uint64][]int32)
+	}
+	n := l.vectors.Len()
+	l.visited.New = func() interface{} {
+		return &visitedSet{marks: make([]uint32, n)}
+	}
+	if l.planes == nil {
+		return
+	}
+
+	// Project blocks of vectors onto every hyperplane at once.
+	for start := 0; start < n; start += lshBlock {
+		end := start + lshBlock
+		if end > n {
+			end = n
+		}
+		block := mat.NewDense(end-start, l.vectors.Dims, l.vectors.Data[start*l.vectors.Dims:end*l.vectors.Dims])
+		var projections mat.Dense
+		projections.Mul(block, l.planes.T())
+		for i := start; i < end; i++ {
+			row := projections.RawRowView(i - start)
+			for t := 0; t < l.Tables; t++ {
+				h := l.hash(row[t*l.Bits : (t+1)*l.Bits])
+				l.buckets[t][h] = append(l.buckets[t][h], int32(i))
+			}
+		}
+	}
+}
+
+// hash converts the projections of a vector onto the hyperplanes of a table into a bucket.
+func (l *LSHIndex) hash(projections []float64) uint64 {
+	var h uint64
+	for b, p := range projections {
+		if p >= 0 {
+			h |= 1 << uint(b)
+		}
+	}
+	return h
+}
+
+// search finds approximately the k vectors most similar to q, excluding the vector skip.
+func (l *LSHIndex) search(q []float64, k int, skip int32) []Concept {
+	if l.planes == nil {
+		return []Concept{}
+	}
+	projections := make([]float64, l.Tables*l.Bits)
+	for i := range projections {
+		projections[i] = floats.Dot(q, l.planes.RawRowView(i))
+	}
+
+	visited := l.visited.Get().(*visitedSet)
+	defer l.visited.Put(visited)
+	visited.reset()
+	if skip >= 0 {
+		visited.visit(skip)
+	}
+
+	t := newTopK(k)
+	bits := make([]int, l.Bits)
+	for table := 0; table < l.Tables; table++ {
+		p := projections[table*l.Bits : (table+1)*l.Bits]
+		h := l.hash(p)
+
+		// Probe the bucket of the query, then the buckets across the hyperplanes closest to the query.
+		for i := range bits {
+			bits[i] = i
+		}
+		sort.Slice(bits, func(i, j int) bool {
+			return math.Abs(p[bits[i]]) < math.Abs(p[bits[j]])
+		})
+		probes := l.Probes
+		if probes > l.Bits {
+			probes = l.Bits
+		}
+		for probe := -1; probe < probes; probe++ {
+			bucket := h
+			if probe >= 0 {
+				bucket ^= 1 << uint(bits[probe])
+			}
+			for _, node := range l.buckets[table][bucket] {
+				if !visited.visit(node) {
+					continue
+				}
+				t.push(Concept{CUI: l.vectors.CUIs[node], Value: floats.Dot(q, l.vectors.Row(int(node)))})
+			}
+		}
+	}
+	return t.sorted()
+}
+
+// SimilarK approximates the k CUIs most similar to an input CUI, sorted by Cosine similarity. Fewer than k CUIs are
+// returned when the probed buckets contain fewer than k other CUIs. Unknown CUIs have no similar CUIs.
+func (l *LSHIndex) SimilarK(cui string, k int) ([]Concept, error) {
+	node, ok := l.vectors.Rows[cui]
+	if !ok || k <= 0 {
+		return []Concept{}, nil
+	}
+	return l.search(l.vectors.Row(node), k, int32(node)), nil
+}
+
+// Similar approximates the K CUIs most similar to an input CUI, or 20 if K is not set.
+func (l *LSHIndex) Similar(cui string) ([]Concept, error) {
+	k := l.K
+	if k <= 0 {
+		k = 20
+	}
+	return l.SimilarK(cui, k)
+}
+
+// WriteModel writes the index to disk. The file begins with the magic bytes "LSHI" and a version, followed by the
+// parameters of the index, the vectors, and the hyperplanes. The buckets are recomputed when the index is loaded.
+func (l *LSHIndex) WriteModel(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(lshMagic); err != nil {
+		return err
+	}
+	if err := writeUint32s(bw, lshVersion, uint32(l.Tables), uint32(l.Bits), uint32(l.Probes)); err != nil {
+		return err
+	}
+	if err := writeDense(bw, l.vectors); err != nil {
+		return err
+	}
+	if l.planes != nil {
+		if err := writeFloat64s(bw, l.planes.RawMatrix().Data); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// LoadModel reads an index written by WriteModel.
+func (l *LSHIndex) LoadModel(r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(lshMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return err
+	}
+	if string(magic) != lshMagic {
+		return errors.New("not an lsh index")
+	}
+
+	var version, tables, bits, probes uint32
+	if err := readUint32s(br, &version, &tables, &bits, &probes); err != nil {
+		return err
+	}
+	if version != lshVersion {
+		return fmt.Errorf("unsupported lsh index version %d", version)
+	}
+	if bits > 64 {
+		return fmt.Errorf("at most 64 bits per table are supported, got %d", bits)
+	}
+	if tables == 0 || tables > maxLSHTables || bits == 0 {
+		return fmt.Errorf("invalid index of %d tables of %d bits", tables, bits)
+	}
+
+	vectors, err := readDense(br)
+	if err != nil {
+		return err
+	}
+	var planes *mat.Dense
+	if vectors.Dims > 0 {
+		data, err := readFloat64Rows(br, int(tables)*int(bits), vectors.Dims)
+		if err != nil {
+			return err
+		}
+		planes = mat.NewDense(int(tables)*int(bits), vectors.Dims, data)
+	}
+
+	l.Tables, l.Bits, l.Probes = int(tables), int(bits), int(probes)
+	l.vectors, l.planes = vectors, planes
+	l.index()
+	return nil
+}
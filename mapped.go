@@ -0,0 +1,372 @@
+package cui2vec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
+	"unsafe"
+)
+
+const (
+	binaryMagic   = "C2VB"
+	binaryVersion = 1
+	// binaryAlign is the alignment in bytes of the first row and of the stride between rows of a binary model.
+	binaryAlign = 64
+)
+
+// littleEndian is true when the host stores floats in the byte order of binary models, so that the rows of a mapped
+// model can be read in place.
+var littleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// MappedEmbeddings are cui2vec embeddings read directly from a binary model written by WriteBinary. When opened with
+// OpenMappedEmbeddings the file is memory-mapped, so startup only reads the CUI table and the pages holding the
+// vectors are loaded on demand and shared between every process that maps the same file.
+//
+// Similarity is Cosine similarity computed from float32 vectors, using the norms stored in the model.
+type MappedEmbeddings struct {
+	dims   int
+	stride int // the number of float32s between the start of consecutive rows
+	cuis   []string
+	rows   map[string]int
+	norms  []float32
+	data   []float32 // CUI x stride
+
+	mapping []byte
+	unmap   func([]byte) error
+}
+
+// WriteBinary writes the embeddings as a binary model that can be opened with OpenMappedEmbeddings. The file begins
+// with the magic bytes "C2VB" and a version, followed by the number of CUIs, the dimensions, the stride and offset of
+// the rows, the CUIs, and the norm of each vector. The vectors are then written as rows of little-endian float32s
+// ordered by CUI, where each row is aligned to 64 bytes. Every vector must have the same number of dimensions.
+func (v *UncompressedEmbeddings) WriteBinary(w io.Writer) error {
+	cuis := make([]string, 0, len(v.Embeddings))
+	for cui := range v.Embeddings {
+		cuis = append(cuis, cui)
+	}
+	sort.Strings(cuis)
+
+	dims := 0
+	if len(cuis) > 0 {
+		dims = len(v.values(v.Embeddings[cuis[0]]))
+	}
+	stride := alignUp(4*dims, binaryAlign) / 4
+
+	// The CUI table and norms are buffered to find the offset of the first row.
+	var table bytes.Buffer
+	if err := writeCUIs(&table, cuis); err != nil {
+		return err
+	}
+	norms := make([]float32, len(cuis))
+	for i, cui := range cuis {
+		vec := v.values(v.Embeddings[cui])
+		if len(vec) != dims {
+			return fmt.Errorf("%s has %d dimensions, expected %d", cui, len(vec), dims)
+		}
+		norms[i] = float32(norm(vec, 2))
+	}
+	if err := writeFloat32s(&table, norms); err != nil {
+		return err
+	}
+	header := len(binaryMagic) + 5*4
+	offset := alignUp(header+table.Len(), binaryAlign)
+	padding := make([]byte, offset-header-table.Len())
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(binaryMagic); err != nil {
+		return err
+	}
+	if err := writeUint32s(bw, binaryVersion, uint32(len(cuis)), uint32(dims), uint32(stride), uint32(offset)); err != nil {
+		return err
+	}
+	if _, err := table.WriteTo(bw); err != nil {
+		return err
+	}
+	if _, err := bw.Write(padding); err != nil {
+		return err
+	}
+	row := make([]float32, stride)
+	for _, cui := range cuis {
+		for j, x := range v.values(v.Embeddings[cui]) {
+			row[j] = float32(x)
+		}
+		if err := writeFloat32s(bw, row); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// alignUp rounds n up to a multiple of align.
+func alignUp(n, align int) int {
+	return (n + align - 1) / align * align
+}
+
+// OpenMappedEmbeddings memory-maps a binary model written by WriteBinary. On platforms without mmap, or when the model
+// is compressed, the model is read into memory instead. Close must be called to release the mapping.
+func OpenMappedEmbeddings(path string) (*MappedEmbeddings, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	b, unmap, err := mmapFile(f, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	if c, _ := DetectCompression(bufio.NewReader(bytes.NewReader(b))); c != NoCompression {
+		m, err := NewMappedEmbeddings(bytes.NewReader(b))
+		if unmap != nil {
+			unmap(b)
+		}
+		return m, err
+	}
+
+	m := new(MappedEmbeddings)
+	if err := m.parse(b); err != nil {
+		if unmap != nil {
+			unmap(b)
+		}
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	m.mapping, m.unmap = b, unmap
+	return m, nil
+}
+
+// NewMappedEmbeddings reads a binary model written by WriteBinary into memory. Unlike OpenMappedEmbeddings, the model
+// may be compressed.
+func NewMappedEmbeddings(r io.Reader) (*MappedEmbeddings, error) {
+	m := new(MappedEmbeddings)
+	err := decompressed(r, m.LoadModel)
+	return m, err
+}
+
+// LoadModel reads a binary model written by WriteBinary into memory, rather than mapping it.
+func (m *MappedEmbeddings) LoadModel(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if err := m.Close(); err != nil {
+		return err
+	}
+	return m.parse(b)
+}
+
+// parse reads the header and CUI table of a binary model, and views the rows in place when possible.
+func (m *MappedEmbeddings) parse(b []byte) error {
+	r := bytes.NewReader(b)
+	magic := make([]byte, len(binaryMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return err
+	}
+	if string(magic) != binaryMagic {
+		return errors.New("not a binary cui2vec model")
+	}
+
+	var version, n, dims, stride, offset uint32
+	if err := readUint32s(r, &version, &n, &dims, &stride, &offset); err != nil {
+		return err
+	}
+	if version != binaryVersion {
+		return fmt.Errorf("unsupported binary model version %d", version)
+	}
+	if dims == 0 || stride < dims || offset%binaryAlign != 0 {
+		return fmt.Errorf("invalid row layout: stride %d for %d dimensions at offset %d", stride, dims, offset)
+	}
+	size := uint64(offset) + uint64(n)*uint64(stride)*4
+	if uint64(len(b)) < size {
+		return fmt.Errorf("binary model is truncated: expected %d bytes, got %d", size, len(b))
+	}
+	// Each CUI takes at least its two-byte length and its four-byte norm between the header and the rows.
+	header := uint64(len(b) - r.Len())
+	if uint64(offset) < header || uint64(n)*6 > uint64(offset)-header {
+		return fmt.Errorf("a table of %d cuis does not fit before the rows at offset %d", n, offset)
+	}
+
+	cuis, err := readCUIs(r, int(n))
+	if err != nil {
+		return err
+	}
+	norms := make([]float32, n)
+	if err := readFloat32s(r, norms); err != nil {
+		return err
+	}
+	if int64(offset) < r.Size()-int64(r.Len()) {
+		return fmt.Errorf("rows at offset %d overlap the cui table", offset)
+	}
+
+	rows := b[offset:size]
+	var data []float32
+	if littleEndian && len(rows) > 0 {
+		h := (*reflect.SliceHeader)(unsafe.Pointer(&data))
+		h.Data = uintptr(unsafe.Pointer(&rows[0]))
+		h.Len = len(rows) / 4
+		h.Cap = len(rows) / 4
+	} else {
+		data = make([]float32, len(rows)/4)
+		for i := range data {
+			data[i] = math.Float32frombits(binary.LittleEndian.Uint32(rows[i*4:]))
+		}
+	}
+
+	m.dims, m.stride = int(dims), int(stride)
+	m.cuis, m.norms, m.data = cuis, norms, data
+	m.rows = make(map[string]int, len(cuis))
+	for i, cui := range cuis {
+		m.rows[cui] = i
+	}
+	return nil
+}
+
+// Close releases the mapping of the model. The embeddings must not be used after they are closed.
+func (m *MappedEmbeddings) Close() error {
+	var err error
+	if m.unmap != nil {
+		err = m.unmap(m.mapping)
+	}
+	m.mapping, m.unmap, m.data = nil, nil, nil
+	return err
+}
+
+// Len is the number of CUIs in the embeddings.
+func (m *MappedEmbeddings) Len() int {
+	return len(m.cuis)
+}
+
+// Dims is the number of dimensions of each vector.
+func (m *MappedEmbeddings) Dims() int {
+	return m.dims
+}
+
+// row returns the float32 vector of a row, which is a view onto the mapping.
+func (m *MappedEmbeddings) row(i int) []float32 {
+	return m.data[i*m.stride : i*m.stride+m.dims]
+}
+
+// Vector returns a copy of the vector of a CUI.
+func (m *MappedEmbeddings) Vector(cui string) ([]float64, bool) {
+	i, ok := m.rows[cui]
+	if !ok {
+		return nil, false
+	}
+	vec := make([]float64, m.dims)
+	for j, x := range m.row(i) {
+		vec[j] = float64(x)
+	}
+	return vec, true
+}
+
+// similar computes the k CUIs most similar to q, excluding the row skip. The rows are divided into blocks that are
+// scanned by each CPU. When softmax is true, the scores are normalised by the softmax over every CUI.
+func (m *MappedEmbeddings) similar(q []float64, k int, skip int, softmax bool) []Concept {
+	qNorm := norm(q, 2)
+	if qNorm == 0 {
+		return []Concept{}
+	}
+
+	workers := runtime.NumCPU()
+	heaps := make([]*topK, workers)
+	sums := make([]logSumExp, workers)
+	for i := range heaps {
+		heaps[i] = newTopK(k)
+	}
+
+	blocks := make(chan int, workers)
+	go func() {
+		for i := 0; i < len(m.cuis); i += scanBatch {
+			blocks <- i
+		}
+		close(blocks)
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for start := range blocks {
+				end := start + scanBatch
+				if end > len(m.cuis) {
+					end = len(m.cuis)
+				}
+				for i := start; i < end; i++ {
+					if i == skip || m.norms[i] == 0 {
+						continue
+					}
+					var dot float64
+					for j, x := range m.row(i) {
+						dot += float64(x) * q[j]
+					}
+					sim := dot / (qNorm * float64(m.norms[i]))
+					heaps[w].push(Concept{CUI: m.cuis[i], Value: sim})
+					sums[w].add(sim)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for i := 1; i < workers; i++ {
+		heaps[0].merge(heaps[i])
+		sums[0].merge(sums[i])
+	}
+	concepts := heaps[0].sorted()
+	if softmax {
+		for i := range concepts {
+			concepts[i].Value = sums[0].softmax(concepts[i].Value)
+		}
+	}
+	return concepts
+}
+
+// Similar computes the Cosine similarity of every CUI to an input CUI, normalised with softmax and sorted.
+func (m *MappedEmbeddings) Similar(cui string) ([]Concept, error) {
+	return m.SimilarKSoftmax(cui, 0)
+}
+
+// SimilarK computes the k CUIs most similar to an input CUI, sorted by Cosine similarity. A k <= 0 returns every
+// CUI. Unknown CUIs have no similar CUIs.
+func (m *MappedEmbeddings) SimilarK(cui string, k int) ([]Concept, error) {
+	vec, ok := m.Vector(cui)
+	if !ok {
+		return []Concept{}, nil
+	}
+	return m.similar(vec, k, m.rows[cui], false), nil
+}
+
+// SimilarKSoftmax computes the k CUIs most similar to an input CUI, where the scores are normalised with the softmax
+// over every CUI.
+func (m *MappedEmbeddings) SimilarKSoftmax(cui string, k int) ([]Concept, error) {
+	vec, ok := m.Vector(cui)
+	if !ok {
+		return []Concept{}, nil
+	}
+	return m.similar(vec, k, m.rows[cui], true), nil
+}
+
+// SimilarVector computes the k CUIs most similar to a vector, sorted by Cosine similarity.
+func (m *MappedEmbeddings) SimilarVector(vec []float64, k int) ([]Concept, error) {
+	if len(vec) != m.dims {
+		return nil, fmt.Errorf("vector has %d dimensions, expected %d", len(vec), m.dims)
+	}
+	return m.similar(vec, k, -1, false), nil
+}
@@ -25,13 +25,19 @@ type frequency struct {
 // In: Pasi G., Piwowarski B., Azzopardi L., Hanbury A. (eds) Advances in Information Retrieval. ECIR 2018.
 // Lecture Notes in Computer Science, vol 10772. Springer, Cham
 //
-// File must reflect this.
+// File must reflect this, and may be compressed with any format recognised by Decompress.
 func LoadCUIMapping(path string) (Mapping, error) {
 	f, err := os.OpenFile(path, os.O_RDONLY, 0644)
 	if err != nil {
 		return nil, err
 	}
-	r := csv.NewReader(f)
+	defer f.Close()
+	dr, err := Decompress(f)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+	r := csv.NewReader(dr)
 	records, err := r.ReadAll()
 	if err != nil {
 		return nil, err
@@ -54,12 +60,20 @@ func LoadCUIMapping(path string) (Mapping, error) {
 	return mapping, nil
 }
 
+// LoadCUIFrequencyMapping loads a mapping of cui to the title with the highest frequency, from a semicolon-separated
+// file of cui, title and frequency with a header row. Compressed files are decompressed transparently.
 func LoadCUIFrequencyMapping(path string) (Mapping, error) {
 	f, err := os.OpenFile(path, os.O_RDONLY, 0644)
 	if err != nil {
 		return nil, err
 	}
-	r := csv.NewReader(f)
+	defer f.Close()
+	dr, err := Decompress(f)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+	r := csv.NewReader(dr)
 	r.Comma = ';'
 	records, err := r.ReadAll()
 	if err != nil {
@@ -109,12 +123,20 @@ func LoadCUIFrequencyMapping(path string) (Mapping, error) {
 	return mapping, nil
 }
 
+// LoadCUIAliasMapping loads a mapping of cui to every one of its titles, from a semicolon-separated file of cui and
+// title with a header row. Compressed files are decompressed transparently.
 func LoadCUIAliasMapping(path string) (AliasMapping, error) {
 	f, err := os.OpenFile(path, os.O_RDONLY, 0644)
 	if err != nil {
 		return nil, err
 	}
-	r := csv.NewReader(f)
+	defer f.Close()
+	dr, err := Decompress(f)
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+	r := csv.NewReader(dr)
 	r.Comma = ';'
 	records, err := r.ReadAll()
 	if err != nil {
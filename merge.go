@@ -0,0 +1,322 @@
+package cui2vec
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MergePolicy determines how Merge combines the vectors of a CUI that is present in more than one source.
+type MergePolicy int
+
+const (
+	// PreferFirst keeps the vector of the first source that contains the CUI.
+	PreferFirst MergePolicy = iota
+	// Average takes the mean of the vectors of every source that contains the CUI.
+	Average
+	// Concatenate joins the vectors of every source end to end, so the merged vectors have the dimensions of every
+	// source. Sources that do not contain a CUI contribute zeros.
+	Concatenate
+)
+
+func (p MergePolicy) String() string {
+	switch p {
+	case PreferFirst:
+		return "first"
+	case Average:
+		return "average"
+	case Concatenate:
+		return "concatenate"
+	}
+	return fmt.Sprintf("MergePolicy(%d)", int(p))
+}
+
+// MergePolicyByName returns the merge policy with the given name (first/average/concatenate).
+func MergePolicyByName(name string) (MergePolicy, error) {
+	for _, p := range []MergePolicy{PreferFirst, Average, Concatenate} {
+		if p.String() == strings.ToLower(name) {
+			return p, nil
+		}
+	}
+	return PreferFirst, fmt.Errorf("unrecognised merge policy %q", name)
+}
+
+// Source is a set of embeddings to merge, and the name that vectors from it are recorded under.
+type Source struct {
+	Name       string
+	Embeddings *UncompressedEmbeddings
+}
+
+// MergedEmbeddings are embeddings merged from several sources. Sources holds, for every CUI, the names of the sources
+// its vector was taken from, in the order the sources were given.
+type MergedEmbeddings struct {
+	*UncompressedEmbeddings
+	Sources map[string][]string
+}
+
+// Merge combines several sets of embeddings into one, using the policy for CUIs present in more than one of them.
+// Every vector of a source must have the same number of dimensions, and unless the policy is Concatenate, every
+// source must have the same number of dimensions. The metric of the merged embeddings is that of the first source, and
+// their vectors never begin with the zero in place of the CUI column.
+func Merge(policy MergePolicy, sources ...Source) (*MergedEmbeddings, error) {
+	if len(sources) == 0 {
+		return nil, errors.New("no embeddings to merge")
+	}
+
+	dims := make([]int, len(sources))
+	total := 0
+	first := -1
+	for i, s := range sources {
+		d, err := sourceDims(s)
+		if err != nil {
+			return nil, err
+		}
+		dims[i] = d
+		total += d
+		// Empty sources are compatible with any other.
+		if len(s.Embeddings.Embeddings) == 0 {
+			continue
+		}
+		if first < 0 {
+			first = i
+		} else if policy != Concatenate && d != dims[first] {
+			return nil, fmt.Errorf("%s has %d dimensions, but %s has %d", s.Name, d, sources[first].Name, dims[first])
+		}
+	}
+
+	embeddings := make(map[string][]float64)
+	names := make(map[string][]string)
+	offset := 0
+	for i, s := range sources {
+		for cui, vec := range s.Embeddings.Embeddings {
+			vec = s.Embeddings.values(vec)
+			merged, ok := embeddings[cui]
+			switch policy {
+			case PreferFirst:
+				if ok {
+					continue
+				}
+				merged = append([]float64(nil), vec...)
+			case Average:
+				if !ok {
+					merged = make([]float64, dims[i])
+				}
+				for j, x := range vec {
+					merged[j] += x
+				}
+			case Concatenate:
+				if !ok {
+					merged = make([]float64, total)
+				}
+				copy(merged[offset:], vec)
+			default:
+				return nil, fmt.Errorf("unrecognised merge policy %d", int(policy))
+			}
+			embeddings[cui] = merged
+			names[cui] = append(names[cui], s.Name)
+		}
+		offset += dims[i]
+	}
+
+	if policy == Average {
+		for cui, vec := range embeddings {
+			n := float64(len(names[cui]))
+			for j := range vec {
+				vec[j] /= n
+			}
+		}
+	}
+
+	v := &UncompressedEmbeddings{
+		Metric:        sources[0].Embeddings.Metric,
+		DropCUIColumn: true,
+	}
+	if err := v.setEmbeddings(embeddings); err != nil {
+		return nil, err
+	}
+	v.Report = LoadReport{Loaded: len(embeddings)}
+	return &MergedEmbeddings{UncompressedEmbeddings: v, Sources: names}, nil
+}
+
+// sourceDims is the number of dimensions of every vector of a source.
+func sourceDims(s Source) (int, error) {
+	dims := -1
+	for cui, vec := range s.Embeddings.Embeddings {
+		vec = s.Embeddings.values(vec)
+		if dims < 0 {
+			dims = len(vec)
+		} else if len(vec) != dims {
+			return 0, fmt.Errorf("%s: %s has %d dimensions, expected %d", s.Name, cui, len(vec), dims)
+		}
+	}
+	if dims < 0 {
+		dims = 0
+	}
+	return dims, nil
+}
+
+// MergeFiles loads the models at the given paths in parallel, and merges them with the policy. Each model is
+// recorded as a source under its path. See LoadSource for the models that can be loaded. Paths to the same file, or
+// to shards of the same sharded model, are loaded once, under the first of those paths.
+func MergeFiles(policy MergePolicy, paths ...string) (*MergedEmbeddings, error) {
+	paths, err := distinctModels(paths)
+	if err != nil {
+		return nil, err
+	}
+	sources := make([]Source, len(paths))
+	errs := make([]error, len(paths))
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		wg.Add(1)
+		go func(i int, path string) {
+			defer wg.Done()
+			sources[i], errs[i] = LoadSource(path)
+		}(i, path)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return Merge(policy, sources...)
+}
+
+// distinctModels removes the paths that load the same model as an earlier path, either because they are the same
+// file or because they are shards of the same sharded model.
+func distinctModels(paths []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var distinct []string
+	for _, path := range paths {
+		model := filepath.Clean(path)
+		shards, ok, err := ShardPaths(path)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			model = filepath.Clean(shards[0])
+		}
+		if !seen[model] {
+			seen[model] = true
+			distinct = append(distinct, path)
+		}
+	}
+	return distinct, nil
+}
+
+// LoadSource loads a model of any format recognised by DetectFormat, which may be compressed. When the path is one
+// shard of a sharded model, such as model-00001-of-00008.csv, every shard is loaded with LoadShards.
+func LoadSource(path string) (Source, error) {
+	s := Source{Name: path}
+	shards, ok, err := ShardPaths(path)
+	if err != nil {
+		return s, err
+	}
+	if ok {
+		s.Embeddings, err = LoadShards(shards...)
+	} else {
+		s.Embeddings, err = loadFile(path)
+	}
+	return s, err
+}
+
+// loadFile loads a model of any format from a file.
+func loadFile(path string) (*UncompressedEmbeddings, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	v, _, err := LoadEmbeddings(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return v, nil
+}
+
+// shardPattern matches the shard number and count in the file name of a sharded model, like model-00001-of-00008.csv.
+var shardPattern = regexp.MustCompile(`^(.*)-(\d+)-of-(\d+)([^-]*)$`)
+
+// ShardPaths returns the path of every shard of the sharded model that path belongs to, and false if the file name
+// of path is not that of a shard. Shards may be numbered from 0 or 1, and every shard must exist.
+func ShardPaths(path string) ([]string, bool, error) {
+	dir, name := filepath.Split(path)
+	m := shardPattern.FindStringSubmatch(name)
+	if m == nil {
+		return nil, false, nil
+	}
+	prefix, index, count, suffix := m[1], m[2], m[3], m[4]
+	i, err := strconv.Atoi(index)
+	if err != nil {
+		return nil, false, err
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil {
+		return nil, false, err
+	}
+
+	shard := func(i int) string {
+		return filepath.Join(dir, fmt.Sprintf("%s-%0*d-of-%s%s", prefix, len(index), i, count, suffix))
+	}
+	first := 1
+	if _, err := os.Stat(shard(0)); err == nil || i == 0 {
+		first = 0
+	}
+	if n == 0 || i >= first+n {
+		return nil, false, fmt.Errorf("%s: shard %d is out of range for %d shards", path, i, n)
+	}
+
+	paths := make([]string, n)
+	for j := range paths {
+		paths[j] = shard(first + j)
+		if _, err := os.Stat(paths[j]); err != nil {
+			return nil, false, fmt.Errorf("missing shard: %w", err)
+		}
+	}
+	return paths, true, nil
+}
+
+// LoadShards loads the shards of a model in parallel and combines them into one set of embeddings. Each CUI must
+// be in only one shard, and every shard must have the same number of dimensions.
+func LoadShards(paths ...string) (*UncompressedEmbeddings, error) {
+	shards := make([]Source, len(paths))
+	errs := make([]error, len(paths))
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		wg.Add(1)
+		go func(i int, path string) {
+			defer wg.Done()
+			shards[i].Name = path
+			shards[i].Embeddings, errs[i] = loadFile(path)
+		}(i, path)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	shard := make(map[string]string)
+	for _, s := range shards {
+		for cui := range s.Embeddings.Embeddings {
+			if other, ok := shard[cui]; ok {
+				return nil, fmt.Errorf("%s is in more than one shard: %s and %s", cui, other, s.Name)
+			}
+			shard[cui] = s.Name
+		}
+	}
+
+	m, err := Merge(PreferFirst, shards...)
+	if err != nil {
+		return nil, err
+	}
+	return m.UncompressedEmbeddings, nil
+}
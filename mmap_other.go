@@ -0,0 +1,15 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package cui2vec
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// mmapFile reads a file into memory on platforms without mmap. There is no mapping to release.
+func mmapFile(f *os.File, size int64) ([]byte, func([]byte) error, error) {
+	b, err := ioutil.ReadAll(f)
+	return b, nil, err
+}
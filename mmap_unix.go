@@ -0,0 +1,24 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package cui2vec
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps size bytes of a file read-only, and returns the mapping and the function that releases it.
+func mmapFile(f *os.File, size int64) ([]byte, func([]byte) error, error) {
+	if size == 0 {
+		return nil, nil, nil
+	}
+	if int64(int(size)) != size {
+		return nil, nil, syscall.EFBIG
+	}
+	b, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, syscall.Munmap, nil
+}
@@ -0,0 +1,353 @@
+package cui2vec
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	npyMagic = "\x93NUMPY"
+	// npyAlign is the alignment of the data of an array, which numpy uses to allow arrays to be memory-mapped.
+	npyAlign = 64
+	// maxNpyDims is the most dimensions of a matrix of embeddings that LoadNumPy accepts, far more than any model has.
+	maxNpyDims = 1 << 20
+)
+
+// npyHeader describes the array stored in a .npy file.
+type npyHeader struct {
+	descr   string
+	fortran bool
+	shape   []int
+}
+
+// writeNpyHeader writes the header of a version 1.0 .npy file holding a C-ordered array of the given type and shape.
+func writeNpyHeader(w io.Writer, descr string, shape ...int) error {
+	dims := make([]string, len(shape))
+	for i, n := range shape {
+		dims[i] = strconv.Itoa(n)
+	}
+	tuple := strings.Join(dims, ", ")
+	if len(shape) == 1 {
+		tuple += ","
+	}
+	header := fmt.Sprintf("{'descr': '%s', 'fortran_order': False, 'shape': (%s), }", descr, tuple)
+
+	// The header is padded with spaces and terminated with a newline, so that the data is aligned.
+	prefix := len(npyMagic) + 4
+	padding := alignUp(prefix+len(header)+1, npyAlign) - prefix - len(header) - 1
+	header += strings.Repeat(" ", padding) + "\n"
+	if len(header) > math.MaxUint16 {
+		return errors.New("npy header is too long")
+	}
+
+	b := make([]byte, prefix, prefix+len(header))
+	copy(b, npyMagic)
+	b[6], b[7] = 1, 0
+	binary.LittleEndian.PutUint16(b[8:], uint16(len(header)))
+	b = append(b, header...)
+	_, err := w.Write(b)
+	return err
+}
+
+// readNpyHeader reads the header of a .npy file of any version.
+func readNpyHeader(r io.Reader) (npyHeader, error) {
+	var h npyHeader
+	b := make([]byte, len(npyMagic)+2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return h, err
+	}
+	if string(b[:len(npyMagic)]) != npyMagic {
+		return h, errors.New("not a npy file")
+	}
+
+	var n int
+	switch major := b[len(npyMagic)]; major {
+	case 1:
+		l := make([]byte, 2)
+		if _, err := io.ReadFull(r, l); err != nil {
+			return h, err
+		}
+		n = int(binary.LittleEndian.Uint16(l))
+	case 2, 3:
+		l := make([]byte, 4)
+		if _, err := io.ReadFull(r, l); err != nil {
+			return h, err
+		}
+		n = int(binary.LittleEndian.Uint32(l))
+	default:
+		return h, fmt.Errorf("unsupported npy version %d", major)
+	}
+	header := make([]byte, n)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return h, err
+	}
+
+	// The header is a Python dictionary literal, such as {'descr': '<f4', 'fortran_order': False, 'shape': (3, 2), }.
+	dict := string(header)
+	descr, err := npyField(dict, "descr")
+	if err != nil {
+		return h, err
+	}
+	h.descr = strings.Trim(descr, `'"`)
+	fortran, err := npyField(dict, "fortran_order")
+	if err != nil {
+		return h, err
+	}
+	h.fortran = fortran == "True"
+	shape, err := npyField(dict, "shape")
+	if err != nil {
+		return h, err
+	}
+	for _, dim := range strings.Split(strings.Trim(shape, "()"), ",") {
+		dim = strings.TrimSpace(dim)
+		if len(dim) == 0 {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(dim, "L"))
+		if err != nil {
+			return h, fmt.Errorf("npy shape %s: %w", shape, err)
+		}
+		h.shape = append(h.shape, n)
+	}
+	return h, nil
+}
+
+// npyField finds the value of a key in the dictionary of a .npy header.
+func npyField(dict, key string) (string, error) {
+	i := strings.Index(dict, "'"+key+"'")
+	if i < 0 {
+		return "", fmt.Errorf("npy header has no %s", key)
+	}
+	value := strings.TrimSpace(dict[i+len(key)+2:])
+	value = strings.TrimSpace(strings.TrimPrefix(value, ":"))
+	end := strings.IndexAny(value, ",}")
+	if strings.HasPrefix(value, "(") {
+		end = strings.Index(value, ")") + 1
+	}
+	if end <= 0 {
+		return "", fmt.Errorf("npy header has a malformed %s", key)
+	}
+	return strings.TrimSpace(value[:end]), nil
+}
+
+// WriteNumPy writes the embeddings as a float32 .npy matrix with a row for each CUI, ordered by CUI, and writes the
+// CUI of each row to vocab, one per line. Every vector must have the same number of dimensions.
+func (v *UncompressedEmbeddings) WriteNumPy(matrix, vocab io.Writer) error {
+	cuis := make([]string, 0, len(v.Embeddings))
+	for cui := range v.Embeddings {
+		cuis = append(cuis, cui)
+	}
+	sort.Strings(cuis)
+
+	dims := 0
+	if len(cuis) > 0 {
+		dims = len(v.values(v.Embeddings[cuis[0]]))
+	}
+
+	bw := bufio.NewWriter(matrix)
+	if err := writeNpyHeader(bw, "<f4", len(cuis), dims); err != nil {
+		return err
+	}
+	row := make([]float32, dims)
+	for _, cui := range cuis {
+		vec := v.values(v.Embeddings[cui])
+		if len(vec) != dims {
+			return fmt.Errorf("%s has %d dimensions, expected %d", cui, len(vec), dims)
+		}
+		for j, x := range vec {
+			row[j] = float32(x)
+		}
+		if err := writeFloat32s(bw, row); err != nil {
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+
+	bw = bufio.NewWriter(vocab)
+	for _, cui := range cuis {
+		if _, err := bw.WriteString(cui + "\n"); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// NewNumPyEmbeddings loads embeddings from a two-dimensional .npy matrix of float32s or float64s, where the CUI of
+// each row is the corresponding line of vocab. Either file may be compressed.
+func NewNumPyEmbeddings(matrix, vocab io.Reader) (*UncompressedEmbeddings, error) {
+	v := &UncompressedEmbeddings{
+		Embeddings: make(map[string][]float64),
+	}
+	err := decompressed(matrix, func(matrix io.Reader) error {
+		return decompressed(vocab, func(vocab io.Reader) error {
+			return v.LoadNumPy(matrix, vocab)
+		})
+	})
+	return v, err
+}
+
+// LoadNumPy loads embeddings from a two-dimensional .npy matrix of little-endian float32s or float64s into memory,
+// replacing any vectors already loaded. The CUI of each row of the matrix is the corresponding line of vocab, which
+// must have a line for every row.
+func (v *UncompressedEmbeddings) LoadNumPy(matrix, vocab io.Reader) error {
+	br := bufio.NewReader(matrix)
+	h, err := readNpyHeader(br)
+	if err != nil {
+		return err
+	}
+	if len(h.shape) != 2 {
+		return fmt.Errorf("expected a two-dimensional matrix, got shape %v", h.shape)
+	}
+	n, dims := h.shape[0], h.shape[1]
+	if n < 0 || dims <= 0 || dims > maxNpyDims {
+		return fmt.Errorf("invalid matrix shape (%d, %d)", n, dims)
+	}
+
+	// The vocabulary is read before the matrix is allocated, so the number of rows is known to be real.
+	var cuis []string
+	scanner := bufio.NewScanner(vocab)
+	for scanner.Scan() {
+		if cui := strings.TrimSpace(scanner.Text()); len(cui) > 0 {
+			if len(cuis) == n {
+				return fmt.Errorf("matrix has %d rows, but the vocabulary has more cuis", n)
+			}
+			cuis = append(cuis, cui)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("vocabulary: %w", err)
+	}
+	if n != len(cuis) {
+		return fmt.Errorf("matrix has %d rows, but the vocabulary has %d cuis", n, len(cuis))
+	}
+	if n > 0 && n*dims/n != dims {
+		return fmt.Errorf("matrix of shape (%d, %d) is too large", n, dims)
+	}
+
+	data := make([]float64, n*dims)
+	switch h.descr {
+	case "<f4":
+		x := make([]float32, dims)
+		for i := 0; i < n; i++ {
+			if err := readFloat32s(br, x); err != nil {
+				return fmt.Errorf("row %d: %w", i+1, unexpectedEOF(err))
+			}
+			for j := range x {
+				data[i*dims+j] = float64(x[j])
+			}
+		}
+	case "<f8":
+		for i := 0; i < n; i++ {
+			if err := readFloat64s(br, data[i*dims:(i+1)*dims]); err != nil {
+				return fmt.Errorf("row %d: %w", i+1, unexpectedEOF(err))
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported npy type %s, expected <f4 or <f8", h.descr)
+	}
+
+	embeddings := make(map[string][]float64, n)
+	for i, cui := range cuis {
+		vec := make([]float64, dims)
+		for j := range vec {
+			if h.fortran {
+				// Fortran-ordered data is stored column by column.
+				vec[j] = data[j*n+i]
+			} else {
+				vec[j] = data[i*dims+j]
+			}
+		}
+		embeddings[cui] = vec
+	}
+	v.Report = LoadReport{Lines: n, Loaded: len(embeddings)}
+	v.DropCUIColumn = true
+	return v.setEmbeddings(embeddings)
+}
+
+// WriteNumPyZ writes the pre-computed neighbours as an .npz archive of .npy arrays. For the n non-empty rows of the
+// matrix, where each row holds k neighbours, the archive contains:
+//
+//	cuis.npy        the number of the CUI of each row (int32, n)
+//	neighbours.npy  the number of the CUI of each neighbour (int32, n x k)
+//	scores.npy      the softmax score of each neighbour (float32, n x k)
+//	raw.npy         the raw score of each neighbour, only for EncodingFloat32 (float32, n x k)
+//
+// The number of a CUI is the integer given by CUI2Int, which is also the row of the CUI in the matrix. Padding at
+// the end of a row has a neighbour of -1 and a score of NaN.
+func (v *PrecomputedEmbeddings) WriteNumPyZ(w io.Writer) error {
+	encoding := v.encoding()
+	stride := encoding.Stride()
+	k := v.Cols / stride
+
+	var rows []int
+	for i, row := range v.Matrix {
+		if len(row) > 0 {
+			rows = append(rows, i)
+		}
+	}
+
+	neighbours := make([]uint32, 0, len(rows)*k)
+	scores := make([]float32, 0, len(rows)*k)
+	raw := make([]float32, 0, len(rows)*k)
+	cuis := make([]uint32, len(rows))
+	for i, r := range rows {
+		cuis[i] = uint32(int32(r))
+		row := v.Matrix[r]
+		for j := 0; j < k; j++ {
+			if (j+1)*stride > len(row) || row[j*stride] == 0 {
+				neighbours = append(neighbours, math.MaxUint32)
+				scores = append(scores, float32(math.NaN()))
+				raw = append(raw, float32(math.NaN()))
+				continue
+			}
+			cols := row[j*stride : (j+1)*stride]
+			neighbours = append(neighbours, uint32(int32(cols[0])))
+			scores = append(scores, float32(v.score(cols, ScoreSoftmax)))
+			if encoding == EncodingFloat32 {
+				raw = append(raw, float32(v.score(cols, ScoreRaw)))
+			} else {
+				raw = append(raw, float32(math.NaN()))
+			}
+		}
+	}
+
+	type array struct {
+		name  string
+		descr string
+		shape []int
+		write func(w io.Writer) error
+	}
+	arrays := []array{
+		{"cuis.npy", "<i4", []int{len(rows)}, func(w io.Writer) error { return writeUint32s(w, cuis...) }},
+		{"neighbours.npy", "<i4", []int{len(rows), k}, func(w io.Writer) error { return writeUint32s(w, neighbours...) }},
+		{"scores.npy", "<f4", []int{len(rows), k}, func(w io.Writer) error { return writeFloat32s(w, scores) }},
+	}
+	if encoding == EncodingFloat32 {
+		arrays = append(arrays, array{"raw.npy", "<f4", []int{len(rows), k}, func(w io.Writer) error { return writeFloat32s(w, raw) }})
+	}
+
+	z := zip.NewWriter(w)
+	for _, a := range arrays {
+		f, err := z.Create(a.name)
+		if err != nil {
+			return err
+		}
+		if err := writeNpyHeader(f, a.descr, a.shape...); err != nil {
+			return err
+		}
+		if err := a.write(f); err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
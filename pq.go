@@ -0,0 +1,385 @@
+package cui2vec
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sync"
+)
+
+const (
+	// DefaultPQSubspaces is the default number of subspaces, and so bytes per CUI, of PQEmbeddings.
+	DefaultPQSubspaces = 50
+	// DefaultPQIterations is the default number of k-means iterations used to train the codebooks of PQEmbeddings.
+	DefaultPQIterations = 20
+
+	pqMagic     = "PQEM"
+	pqVersion   = 1
+	pqCentroids = 256
+	pqSample    = 32768
+)
+
+// PQEmbeddings are cui2vec embeddings compressed with product quantisation. Each vector is L2-normalised and split
+// into Subspaces contiguous sub-vectors, and each sub-vector is replaced by the one-byte index of the closest of 256
+// centroids in the codebook of its subspace. A model of 100k CUIs with 50 subspaces therefore needs 5MB of codes.
+// See: Jégou, Douze, Schmid (2011) Product Quantization for Nearest Neighbor Search. IEEE TPAMI.
+//
+// Queries use asymmetric distance computation: the query vector is compared with every centroid once, after which
+// the approximate Cosine similarity of every CUI is the sum of a table lookup per subspace. K is the number of CUIs
+// returned by Similar.
+type PQEmbeddings struct {
+	Subspaces int
+	K         int
+
+	dims      int
+	bounds    []int       // the first dimension of each subspace, and the number of dimensions
+	codebooks [][]float32 // subspace -> centroid x sub-dimensions
+	codes     []byte      // CUI x subspace
+	norms     []float32   // the norm of the reconstruction of each CUI
+	cuis      []string
+	rows      map[string]int
+}
+
+// TrainPQEmbeddings learns the codebooks of each subspace with k-means over a sample of the vectors of the
+// embeddings, and then encodes every vector. Values <= 0 use DefaultPQSubspaces and DefaultPQIterations.
+func TrainPQEmbeddings(e *UncompressedEmbeddings, subspaces, iterations int) (*PQEmbeddings, error) {
+	if subspaces <= 0 {
+		subspaces = DefaultPQSubspaces
+	}
+	if iterations <= 0 {
+		iterations = DefaultPQIterations
+	}
+
+	vectors, err := normalisedMatrix(e)
+	if err != nil {
+		return nil, err
+	}
+	if vectors.Len() == 0 {
+		return nil, errors.New("cannot train product quantisation without vectors")
+	}
+	if subspaces > vectors.Dims {
+		return nil, fmt.Errorf("%d subspaces is more than the %d dimensions", subspaces, vectors.Dims)
+	}
+
+	p := &PQEmbeddings{
+		Subspaces: subspaces,
+		dims:      vectors.Dims,
+		cuis:      vectors.CUIs,
+		rows:      vectors.Rows,
+	}
+	p.init()
+
+	// Train the codebook of each subspace on a sample of the vectors.
+	rng := rand.New(rand.NewSource(1))
+	sample := rng.Perm(vectors.Len())
+	if len(sample) > pqSample {
+		sample = sample[:pqSample]
+	}
+	p.codebooks = make([][]float32, subspaces)
+	var wg sync.WaitGroup
+	for s := 0; s < subspaces; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			lo, hi := p.bounds[s], p.bounds[s+1]
+			data := make([][]float64, len(sample))
+			for i, row := range sample {
+				data[i] = vectors.Row(row)[lo:hi]
+			}
+			p.codebooks[s] = kmeans(data, pqCentroids, iterations, rand.New(rand.NewSource(int64(s)+1)))
+		}(s)
+	}
+	wg.Wait()
+
+	// Encode every vector with the closest centroid of each subspace.
+	p.codes = make([]byte, vectors.Len()*subspaces)
+	for i := 0; i < vectors.Len(); i++ {
+		vec := vectors.Row(i)
+		for s := 0; s < subspaces; s++ {
+			p.codes[i*subspaces+s] = byte(closestCentroid(vec[p.bounds[s]:p.bounds[s+1]], p.codebooks[s]))
+		}
+	}
+	p.computeNorms()
+	return p, nil
+}
+
+// NewPQEmbeddings reads compressed embeddings written by WriteModel. The file itself may also be gzip, bzip2 or zstd
+// compressed.
+func NewPQEmbeddings(r io.Reader) (*PQEmbeddings, error) {
+	p := new(PQEmbeddings)
+	err := decompressed(r, p.LoadModel)
+	return p, err
+}
+
+// init divides the dimensions as evenly as possible between the subspaces.
+func (p *PQEmbeddings) init() {
+	p.bounds = make([]int, p.Subspaces+1)
+	for s := range p.bounds {
+		p.bounds[s] = s * p.dims / p.Subspaces
+	}
+}
+
+// computeNorms computes the norm of the reconstruction of every CUI.
+func (p *PQEmbeddings) computeNorms() {
+	sq := make([][]float64, p.Subspaces)
+	for s, codebook := range p.codebooks {
+		d := p.bounds[s+1] - p.bounds[s]
+		sq[s] = make([]float64, pqCentroids)
+		for c := range sq[s] {
+			for _, x := range codebook[c*d : (c+1)*d] {
+				sq[s][c] += float64(x) * float64(x)
+			}
+		}
+	}
+	p.norms = make([]float32, len(p.cuis))
+	for i := range p.norms {
+		var n float64
+		for s, code := range p.codes[i*p.Subspaces : (i+1)*p.Subspaces] {
+			n += sq[s][code]
+		}
+		p.norms[i] = float32(math.Sqrt(n))
+	}
+}
+
+// kmeans clusters data into k centroids, returned as a flattened centroid x dimensions slice.
+func kmeans(data [][]float64, k, iterations int, rng *rand.Rand) []float32 {
+	d := len(data[0])
+	centroids := make([]float32, k*d)
+	seed := func(c int) {
+		row := data[rng.Intn(len(data))]
+		for j, x := range row {
+			centroids[c*d+j] = float32(x)
+		}
+	}
+	perm := rng.Perm(len(data))
+	for c := 0; c < k; c++ {
+		if c < len(perm) {
+			for j, x := range data[perm[c]] {
+				centroids[c*d+j] = float32(x)
+			}
+		} else {
+			seed(c)
+		}
+	}
+
+	assignments := make([]int, len(data))
+	sums := make([]float64, k*d)
+	counts := make([]int, k)
+	for it := 0; it < iterations; it++ {
+		changed := false
+		for i, x := range data {
+			c := closestCentroid(x, centroids)
+			if c != assignments[i] || it == 0 {
+				changed = true
+			}
+			assignments[i] = c
+		}
+		if !changed {
+			break
+		}
+
+		for i := range sums {
+			sums[i] = 0
+		}
+		for i := range counts {
+			counts[i] = 0
+		}
+		for i, x := range data {
+			c := assignments[i]
+			counts[c]++
+			for j, v := range x {
+				sums[c*d+j] += v
+			}
+		}
+		for c := 0; c < k; c++ {
+			if counts[c] == 0 {
+				// Re-seed empty clusters so that every centroid is used.
+				seed(c)
+				continue
+			}
+			for j := 0; j < d; j++ {
+				centroids[c*d+j] = float32(sums[c*d+j] / float64(counts[c]))
+			}
+		}
+	}
+	return centroids
+}
+
+// closestCentroid returns the index of the centroid with the smallest Euclidean distance to x.
+func closestCentroid(x []float64, centroids []float32) int {
+	d := len(x)
+	best, bestDist := 0, math.Inf(1)
+	for c := 0; c < len(centroids)/d; c++ {
+		var dist float64
+		for j, v := range x {
+			diff := v - float64(centroids[c*d+j])
+			dist += diff * diff
+		}
+		if dist < bestDist {
+			best, bestDist = c, dist
+		}
+	}
+	return best
+}
+
+// Len is the number of CUIs in the embeddings.
+func (p *PQEmbeddings) Len() int {
+	return len(p.cuis)
+}
+
+// Vector approximates the L2-normalised vector of a CUI by concatenating the centroids of its code.
+func (p *PQEmbeddings) Vector(cui string) ([]float64, bool) {
+	row, ok := p.rows[cui]
+	if !ok {
+		return nil, false
+	}
+	vec := make([]float64, p.dims)
+	for s, code := range p.codes[row*p.Subspaces : (row+1)*p.Subspaces] {
+		lo, hi := p.bounds[s], p.bounds[s+1]
+		centroid := p.codebooks[s][int(code)*(hi-lo) : (int(code)+1)*(hi-lo)]
+		for j, x := range centroid {
+			vec[lo+j] = float64(x)
+		}
+	}
+	return vec, true
+}
+
+// search approximates the k CUIs most similar to q with asymmetric distance computation, excluding the row skip.
+func (p *PQEmbeddings) search(q []float64, k int, skip int) []Concept {
+	qNorm := norm(q, 2)
+	if qNorm == 0 {
+		return []Concept{}
+	}
+
+	// Compare the query with every centroid of every subspace.
+	table := make([]float64, p.Subspaces*pqCentroids)
+	for s, codebook := range p.codebooks {
+		lo, hi := p.bounds[s], p.bounds[s+1]
+		sub := q[lo:hi]
+		for c := 0; c < pqCentroids; c++ {
+			var dot float64
+			for j, x := range codebook[c*(hi-lo) : (c+1)*(hi-lo)] {
+				dot += float64(x) * sub[j]
+			}
+			table[s*pqCentroids+c] = dot
+		}
+	}
+
+	t := newTopK(k)
+	for row := range p.cuis {
+		if row == skip || p.norms[row] == 0 {
+			continue
+		}
+		var dot float64
+		for s, code := range p.codes[row*p.Subspaces : (row+1)*p.Subspaces] {
+			dot += table[s*pqCentroids+int(code)]
+		}
+		t.push(Concept{CUI: p.cuis[row], Value: dot / (qNorm * float64(p.norms[row]))})
+	}
+	return t.sorted()
+}
+
+// SimilarK approximates the k CUIs most similar to an input CUI, sorted by approximate Cosine similarity.
+// As the original vector of the CUI is not stored, its reconstruction is used as the query. A k <= 0 returns every
+// CUI. Unknown CUIs have no similar CUIs.
+func (p *PQEmbeddings) SimilarK(cui string, k int) ([]Concept, error) {
+	vec, ok := p.Vector(cui)
+	if !ok {
+		return []Concept{}, nil
+	}
+	return p.search(vec, k, p.rows[cui]), nil
+}
+
+// SimilarVector approximates the k CUIs most similar to a vector, sorted by approximate Cosine similarity.
+func (p *PQEmbeddings) SimilarVector(vec []float64, k int) ([]Concept, error) {
+	if len(vec) != p.dims {
+		return nil, fmt.Errorf("vector has %d dimensions, expected %d", len(vec), p.dims)
+	}
+	return p.search(vec, k, -1), nil
+}
+
+// Similar approximates the K CUIs most similar to an input CUI, or 20 if K is not set.
+func (p *PQEmbeddings) Similar(cui string) ([]Concept, error) {
+	k := p.K
+	if k <= 0 {
+		k = 20
+	}
+	return p.SimilarK(cui, k)
+}
+
+// WriteModel writes the compressed embeddings to disk. The file begins with the magic bytes "PQEM" and a version,
+// followed by the number of CUIs, dimensions and subspaces, the float32 codebooks, the CUIs, and the codes.
+func (p *PQEmbeddings) WriteModel(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(pqMagic); err != nil {
+		return err
+	}
+	if err := writeUint32s(bw, pqVersion, uint32(len(p.cuis)), uint32(p.dims), uint32(p.Subspaces)); err != nil {
+		return err
+	}
+	for _, codebook := range p.codebooks {
+		if err := writeFloat32s(bw, codebook); err != nil {
+			return err
+		}
+	}
+	if err := writeCUIs(bw, p.cuis); err != nil {
+		return err
+	}
+	if _, err := bw.Write(p.codes); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// LoadModel reads compressed embeddings written by WriteModel.
+func (p *PQEmbeddings) LoadModel(r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(pqMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return err
+	}
+	if string(magic) != pqMagic {
+		return errors.New("not a product quantised model")
+	}
+
+	var version, n, dims, subspaces uint32
+	if err := readUint32s(br, &version, &n, &dims, &subspaces); err != nil {
+		return err
+	}
+	if version != pqVersion {
+		return fmt.Errorf("unsupported product quantised model version %d", version)
+	}
+	if subspaces == 0 || subspaces > dims {
+		return fmt.Errorf("invalid number of subspaces %d for %d dimensions", subspaces, dims)
+	}
+
+	p.Subspaces, p.dims = int(subspaces), int(dims)
+	p.init()
+	p.codebooks = make([][]float32, p.Subspaces)
+	for s := range p.codebooks {
+		p.codebooks[s] = make([]float32, pqCentroids*(p.bounds[s+1]-p.bounds[s]))
+		if err := readFloat32s(br, p.codebooks[s]); err != nil {
+			return err
+		}
+	}
+
+	cuis, err := readCUIs(br, int(n))
+	if err != nil {
+		return err
+	}
+	p.cuis = cuis
+	p.rows = make(map[string]int, len(cuis))
+	for i, cui := range cuis {
+		p.rows[cui] = i
+	}
+
+	p.codes = make([]byte, len(cuis)*p.Subspaces)
+	if _, err := io.ReadFull(br, p.codes); err != nil {
+		return err
+	}
+	p.computeNorms()
+	return nil
+}
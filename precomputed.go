@@ -1,153 +1,472 @@
 package cui2vec
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
-	"io/ioutil"
 	"math"
 )
 
+const (
+	precomputedMagic   = "C2VP"
+	precomputedVersion = 2
+)
+
+// Encoding is the way the scores of a PrecomputedEmbeddings matrix are stored.
+type Encoding uint32
+
+const (
+	// EncodingFixedPoint stores each concept as a (CUI, score) pair, where the score is an integer holding the first
+	// seven decimal places of the softmax score. This is the encoding of files without a header.
+	EncodingFixedPoint Encoding = iota + 1
+	// EncodingFloat32 stores each concept as a (CUI, raw score, softmax score) triple, where the scores are the bits
+	// of float32s.
+	EncodingFloat32
+)
+
+// flagVariableRows is set in the header of files where each row stores its own length, rather than being padded.
+const flagVariableRows uint32 = 1
+
+// fixedPointScale is the value by which scores are multiplied to be stored with EncodingFixedPoint.
+const fixedPointScale = 1e7
+
+func (e Encoding) String() string {
+	switch e {
+	case EncodingFixedPoint:
+		return "fixed-point"
+	case EncodingFloat32:
+		return "float32"
+	}
+	return fmt.Sprintf("Encoding(%d)", uint32(e))
+}
+
+// Stride is the number of columns used by each concept in a row.
+func (e Encoding) Stride() int {
+	if e == EncodingFloat32 {
+		return 3
+	}
+	return 2
+}
+
+// ScoreKind selects which of the scores stored for each concept is returned by PrecomputedEmbeddings.
+type ScoreKind int
+
+const (
+	// ScoreSoftmax is the score normalised with softmax over every CUI.
+	ScoreSoftmax ScoreKind = iota
+	// ScoreRaw is the score of the metric, such as the Cosine similarity. Only EncodingFloat32 stores raw scores.
+	ScoreRaw
+)
+
 // PrecomputedEmbeddings is a type of cui2vec container where the distances between CUIs have been pre-computed.
 // It contains a sparse Matrix where the rows are CUIs and the columns are the distances to other CUIs.
 // Each row is formatted in the form [CUI, score, CUI, score, ...].
 // Each CUI must be converted back to a string, and each score must be re-normalised from an int back to a float (taken care of by the Similar method).
+// Encoding and Metric describe how the scores were computed, and are stored in the header of the file along with Cols.
+// Score selects which score is returned by Similar.
+//
+// Fingerprint identifies the model that the scores were computed from (see UncompressedEmbeddings.Fingerprint). When
+// the rows were computed in shards, Shard is the number of the shard from 1 to Shards, and holds the rows of the CUIs
+// given by ShardOf. Expected is the number of rows that were to be computed, so that missing rows can be detected.
+// These are also stored in the header, and are zero when unknown.
+//
+// Rows may hold fewer than `Cols` values. Unless VariableRows is set, such rows are padded with zeros on disk, which
+// Similar ignores. With VariableRows, each row is written with its length instead, so that rows holding only a few
+// neighbours take only the space they need, and `Cols` is the most values a row may hold.
 type PrecomputedEmbeddings struct {
-	Matrix [][]int
-	Cols   int
+	Matrix       [][]int
+	Cols         int
+	Encoding     Encoding
+	Metric       string
+	Score        ScoreKind
+	Fingerprint  uint64
+	Shard        int
+	Shards       int
+	Expected     int
+	VariableRows bool
 }
 
-// LoadModel reads a model from disk into memory. The file format of the pre-computed distances
-// file is that of a single, continuous byte sequence starting with four bytes indicating the rows in the matrix.
-// The first four bytes indicate a single Uint32 number representing the size of the matrix.
+// LoadModel reads a model from disk into memory. Files written by WriteModel begin with a header that is validated
+// and describes the shape of the matrix, as documented by WriteModel.
+//
+// Legacy files have no header, and are a single, continuous byte sequence starting with four bytes indicating the
+// rows in the matrix. The first four bytes indicate a single Uint32 number representing the size of the matrix.
 // This is used to create a fixed-size sparse matrix. The `Cols` attribute of the `PrecomputedEmbeddings` type
 // is used to read N four-byte Uint32 numbers at a time to populate the columns of the matrix.
+//
+// The file is decoded one row at a time, so that it is never held in memory alongside the matrix. Truncated or
+// corrupt files result in an error, and leave the embeddings unchanged.
 func (v *PrecomputedEmbeddings) LoadModel(r io.Reader) error {
-	var (
-		matrix [][]int
-		size   int
-		idx    int
-	)
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(precomputedMagic))
+	if err != nil {
+		return fmt.Errorf("precomputed model header: %w", unexpectedEOF(err))
+	}
+
+	if string(magic) != precomputedMagic {
+		var size uint32
+		if err := readUint32s(br, &size); err != nil {
+			return fmt.Errorf("precomputed model header: %w", unexpectedEOF(err))
+		}
+		matrix, err := readRows(br, int(size), v.Cols, false)
+		if err != nil {
+			return err
+		}
+		v.Matrix = matrix
+		if v.Encoding == 0 {
+			v.Encoding = EncodingFixedPoint
+		}
+		return nil
+	}
+
+	// The checksum covers every byte of the file except itself.
+	h := crc32.NewIEEE()
+	tr := io.TeeReader(br, h)
+	if _, err := io.ReadFull(tr, make([]byte, len(precomputedMagic))); err != nil {
+		return err
+	}
+	var version, size, cols, encoding, flags, checksum uint32
+	if err := readUint32s(tr, &version, &size, &cols, &encoding, &flags); err != nil {
+		return fmt.Errorf("precomputed model header: %w", unexpectedEOF(err))
+	}
+	if version < 1 || version > precomputedVersion {
+		return fmt.Errorf("unsupported precomputed model version %d", version)
+	}
+	if cols == 0 {
+		return errors.New("precomputed model has no columns")
+	}
+	if Encoding(encoding) != EncodingFixedPoint && Encoding(encoding) != EncodingFloat32 {
+		return fmt.Errorf("unsupported precomputed score encoding %d", encoding)
+	}
+	if int(cols)%Encoding(encoding).Stride() != 0 {
+		return fmt.Errorf("%d columns cannot hold %s concepts", cols, Encoding(encoding))
+	}
+	if flags&^flagVariableRows != 0 {
+		return fmt.Errorf("unsupported precomputed model flags %#x", flags)
+	}
+	metric, err := readString(tr)
+	if err != nil {
+		return fmt.Errorf("precomputed model header: %w", unexpectedEOF(err))
+	}
+	// Version 2 records the model and shard that the rows were computed from.
+	var fingerprintLow, fingerprintHigh, shard, shards, expected uint32
+	if version >= 2 {
+		if err := readUint32s(tr, &fingerprintLow, &fingerprintHigh, &shard, &shards, &expected); err != nil {
+			return fmt.Errorf("precomputed model header: %w", unexpectedEOF(err))
+		}
+		if shard > shards {
+			return fmt.Errorf("invalid shard %d of %d", shard, shards)
+		}
+	}
+	if err := readUint32s(br, &checksum); err != nil {
+		return fmt.Errorf("precomputed model header: %w", unexpectedEOF(err))
+	}
 
-	b, err := ioutil.ReadAll(r)
+	variable := flags&flagVariableRows != 0
+	matrix, err := readRows(tr, int(size), int(cols), variable)
 	if err != nil {
 		return err
 	}
+	if h.Sum32() != checksum {
+		return fmt.Errorf("precomputed model is corrupt: checksum %08x does not match %08x", h.Sum32(), checksum)
+	}
+
+	v.Matrix, v.Cols, v.Encoding, v.Metric = matrix, int(cols), Encoding(encoding), metric
+	v.Fingerprint = uint64(fingerprintHigh)<<32 | uint64(fingerprintLow)
+	v.Shard, v.Shards, v.Expected = int(shard), int(shards), int(expected)
+	v.VariableRows = variable
+	return nil
+}
 
-	size = int(binary.LittleEndian.Uint32(b[:4]))
-	matrix = make([][]int, size)
+// maxCUI is the largest number of a CUI.
+const maxCUI = 9999999
 
-	// i = matrix row; j = bytes position; k = matrix column.
-	for i, j, k := 0, 4, 0; i < size; i++ {
-		if k == 0 { // Start of new section
-			if j > len(b) {
-				k = 0
-				continue
-			}
-			idx = int(binary.LittleEndian.Uint32(b[j : j+4]))
-			matrix[idx] = make([]int, v.Cols)
-		} else {
-			if idx > len(matrix) || len(matrix[idx]) == 0 {
-				k = 0
-				continue
+// readRows reads the rows of a matrix with size rows until the end of r, where each row is the index of the row
+// followed by cols values or, if variable is set, by the number of values and then the values, of which there are at
+// most cols. The matrix only grows to size once every row has been read, so that a corrupt size does not allocate
+// memory before an error is found. Rows are indexed by CUI, so size is at most one more than the largest CUI.
+func readRows(r io.Reader, size, cols int, variable bool) ([][]int, error) {
+	if cols <= 0 {
+		return nil, fmt.Errorf("invalid number of columns %d", cols)
+	}
+	if size < 0 || size > maxCUI+1 {
+		return nil, fmt.Errorf("invalid matrix size %d, expected at most %d", size, maxCUI+1)
+	}
+
+	var matrix [][]int
+	prefix := 4
+	if variable {
+		prefix = 8
+	}
+	buf := make([]byte, prefix+cols*4)
+	for row := 1; ; row++ {
+		b := buf[:prefix]
+		n, err := io.ReadFull(r, b)
+		if err == io.EOF {
+			break
+		}
+		width := cols
+		if err == nil && variable {
+			width = int(binary.LittleEndian.Uint32(b[4:]))
+			if width > cols {
+				return nil, fmt.Errorf("row %d has %d values, but rows have at most %d", row, width, cols)
 			}
-			matrix[idx][k-1] = int(binary.LittleEndian.Uint32(b[j : j+4]))
 		}
-		k++
-		if k == v.Cols+1 {
-			k = 0
+		if err == nil {
+			b = buf[:prefix+width*4]
+			n, err = io.ReadFull(r, b[prefix:])
+			n += prefix
+			err = unexpectedEOF(err)
+		}
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("row %d is truncated: read %d of %d bytes", row, n, len(b))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %w", row, err)
+		}
+
+		idx := int(binary.LittleEndian.Uint32(b))
+		if idx >= size {
+			return nil, fmt.Errorf("row %d has index %d outside of a matrix of size %d", row, idx, size)
 		}
-		j += 4
+		b = b[prefix:]
+		vals := make([]int, width)
+		for k := range vals {
+			vals[k] = int(binary.LittleEndian.Uint32(b[k*4:]))
+		}
+		for len(matrix) <= idx {
+			matrix = append(matrix, nil)
+		}
+		matrix[idx] = vals
 	}
-	v.Matrix = matrix
-	return nil
+	return append(matrix, make([][]int, size-len(matrix))...), nil
+}
+
+// unexpectedEOF converts io.EOF into io.ErrUnexpectedEOF, for reads that should not reach the end of a file.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
 }
 
 // WriteModel writes a pre-computed distance matrix to disk.
-// The write begins with a four-byte sequence to be parsed as a Uint32 representing the
-// size of the matrix. Each value of the matrix is then written one by one in a continuous
-// byte sequence, where each element in the matrix is encoded as a four-byte sequence to
-// be parsed as a Uint32. Elements of the matrix are written row-by-row, and each row
-// is exactly `Cols` wide. If there are less than `Cols` elements in a row, the row is
-// padded with zeros.
+// The write begins with a header: the magic bytes "C2VP", followed by four-byte sequences to be parsed as Uint32s
+// holding the version, the size of the matrix, `Cols`, the `Encoding` and a set of flags, then the name of the
+// `Metric`, the low and high halves of the `Fingerprint`, `Shard`, `Shards` and `Expected`, and finally a CRC-32
+// checksum of every other byte in the file.
+// Each row of the matrix is then written one by one in a continuous byte sequence, as the index of the row
+// followed by its elements, where each is encoded as a four-byte sequence to be parsed as a Uint32.
+// Empty rows are skipped, and each row is exactly `Cols` wide. If there are less than `Cols` elements in a row, the
+// row is padded with zeros. When `VariableRows` is set, the flags say so, and the index of each row is instead
+// followed by the number of its elements and then only those elements. Only nil rows are skipped, so that a CUI
+// without any neighbours, such as when none are similar enough, is distinguished from one that was not computed.
 func (v *PrecomputedEmbeddings) WriteModel(w io.Writer) error {
-	d := make([]byte, 4)
-	binary.LittleEndian.PutUint32(d, uint32(len(v.Matrix)))
-	_, err := w.Write(d)
-	if err != nil {
+	encoding := v.encoding()
+	if v.Cols%encoding.Stride() != 0 {
+		return fmt.Errorf("%d columns cannot hold %s concepts", v.Cols, encoding)
+	}
+
+	var header bytes.Buffer
+	header.WriteString(precomputedMagic)
+	var flags uint32
+	if v.VariableRows {
+		flags |= flagVariableRows
+	}
+	if err := writeUint32s(&header, precomputedVersion, uint32(len(v.Matrix)), uint32(v.Cols), uint32(encoding), flags); err != nil {
+		return err
+	}
+	if err := writeString(&header, v.Metric); err != nil {
+		return err
+	}
+	if v.Shard < 0 || v.Shards < 0 || v.Shard > v.Shards {
+		return fmt.Errorf("invalid shard %d of %d", v.Shard, v.Shards)
+	}
+	if err := writeUint32s(&header, uint32(v.Fingerprint), uint32(v.Fingerprint>>32), uint32(v.Shard), uint32(v.Shards), uint32(v.Expected)); err != nil {
+		return err
+	}
+
+	// The rows are encoded twice: once to compute the checksum, and again to write them.
+	h := crc32.NewIEEE()
+	h.Write(header.Bytes())
+	if err := v.writeRows(h); err != nil {
 		return err
 	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := header.WriteTo(bw); err != nil {
+		return err
+	}
+	if err := writeUint32s(bw, h.Sum32()); err != nil {
+		return err
+	}
+	if err := v.writeRows(bw); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// writeRows writes the rows of the matrix as described by WriteModel, cutting rows to `Cols` elements.
+func (v *PrecomputedEmbeddings) writeRows(w io.Writer) error {
+	prefix := 4
+	if v.VariableRows {
+		prefix = 8
+	}
+	buf := make([]byte, prefix+v.Cols*4)
 	for i := range v.Matrix {
-		if len(v.Matrix[i]) == 0 {
+		// Variable rows may record that a CUI has no neighbours.
+		if v.Matrix[i] == nil || len(v.Matrix[i]) == 0 && !v.VariableRows {
 			continue
 		}
-		b := make([]byte, (v.Cols*4)+4)
-		d := make([]byte, 4)
-		binary.LittleEndian.PutUint32(d, uint32(i))
-		b[0] = d[0]
-		b[1] = d[1]
-		b[2] = d[2]
-		b[3] = d[3]
-		for j, k := 0, 4; j < v.Cols; j++ {
-			d := make([]byte, 4)
+		width := v.Cols
+		if v.VariableRows && len(v.Matrix[i]) < width {
+			width = len(v.Matrix[i])
+		}
+		b := buf[:prefix+width*4]
+		binary.LittleEndian.PutUint32(b, uint32(i))
+		if v.VariableRows {
+			binary.LittleEndian.PutUint32(b[4:], uint32(width))
+		}
+		for j := 0; j < width; j++ {
+			var val uint32
 			if j < len(v.Matrix[i]) {
-				binary.LittleEndian.PutUint32(d, uint32(v.Matrix[i][j]))
-			} else {
-				d = []byte{0, 0, 0, 0}
+				val = uint32(v.Matrix[i][j])
 			}
-			b[k] = d[0]
-			b[k+1] = d[1]
-			b[k+2] = d[2]
-			b[k+3] = d[3]
-			k += 4
+			binary.LittleEndian.PutUint32(b[prefix+j*4:], val)
 		}
-		_, err := w.Write(b)
-		if err != nil {
+		if _, err := w.Write(b); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// Similar matches a given input CUI to the `Cols`-closest CUIs in the cui2vec embedding space.
-// As each row in the matrix is encoded into (CUI, score) pairs, this method handles that.
-// It also converts each int value in the matrix into either a string CUI or a re-normalised softmax score float64.
+// encoding returns the Encoding of the matrix, which is EncodingFixedPoint unless otherwise specified.
+func (v *PrecomputedEmbeddings) encoding() Encoding {
+	if v.Encoding == 0 {
+		return EncodingFixedPoint
+	}
+	return v.Encoding
+}
+
+// Similar matches a given input CUI to the closest CUIs that were pre-computed, sorted by score.
+// As each row in the matrix is encoded into (CUI, score) pairs or (CUI, raw score, softmax score) triples depending
+// on the Encoding, this method handles that. It also converts each int value in the matrix into either a string CUI
+// or the score selected by Score. Padding at the end of a row, which has a CUI of zero, is skipped.
 func (v *PrecomputedEmbeddings) Similar(cui string) ([]Concept, error) {
 	c, err := CUI2Int(cui)
 	if err != nil {
 		return nil, err
 	}
 
-	var (
-		concept  string
-		score    float64
-		concepts []Concept
-	)
+	encoding := v.encoding()
+	if v.Score == ScoreRaw && encoding != EncodingFloat32 {
+		return nil, fmt.Errorf("raw scores are not stored with the %s encoding", encoding)
+	}
 
 	// Exit early if the CUI is malformed.
+	var concepts []Concept
 	if c >= len(v.Matrix) || c < 0 {
 		return concepts, nil
 	}
 
 	// Create a slice of concepts from the number of pre-computed scores.
-	concepts = make([]Concept, v.Cols/2)
-	j := 0
-	for i, val := range v.Matrix[c] {
-		if i%2 != 0 {
-			// Convert the very large int score back into the softmax score.
-			// This works by finding the log-10 of the value, taking the ceiling of it, and taking the power of 10 to that value.
-			// This finds the value by which the very large number should be divided by in order to convert it back to the original score.
-			score = float64(val) / math.Pow(10, math.Ceil(math.Log10(float64(val))))
-
-			c := Concept{
-				CUI:   concept,
-				Value: score,
-			}
-			concepts[j] = c
-			j++
-		} else {
-			concept = Int2CUI(val)
+	row := v.Matrix[c]
+	stride := encoding.Stride()
+	concepts = make([]Concept, 0, len(row)/stride)
+	for i := 0; i+stride <= len(row); i += stride {
+		if row[i] == 0 {
+			continue
 		}
+		concepts = append(concepts, Concept{
+			CUI:   Int2CUI(row[i]),
+			Value: v.score(row[i:i+stride], v.Score),
+		})
 	}
 
 	return concepts, nil
 }
+
+// score decodes a score of the given kind from the columns of a concept.
+func (v *PrecomputedEmbeddings) score(cols []int, kind ScoreKind) float64 {
+	if v.encoding() == EncodingFloat32 {
+		// The raw score is followed by the softmax score.
+		if kind == ScoreRaw {
+			return float64(math.Float32frombits(uint32(cols[1])))
+		}
+		return float64(math.Float32frombits(uint32(cols[2])))
+	}
+	return float64(cols[1]) / fixedPointScale
+}
+
+// SimilarK matches a given input CUI to at most the k closest CUIs that were pre-computed. The scores are those
+// stored in the matrix, so at most `Cols` divided by the `Stride` of the `Encoding` CUIs are available. A k <= 0
+// returns every pre-computed CUI.
+func (v *PrecomputedEmbeddings) SimilarK(cui string, k int) ([]Concept, error) {
+	concepts, err := v.Similar(cui)
+	if err != nil {
+		return nil, err
+	}
+	if k > 0 && len(concepts) > k {
+		concepts = concepts[:k]
+	}
+	return concepts, nil
+}
+
+// Migrate converts a matrix stored with EncodingFixedPoint to EncodingFloat32, so that it can be written without
+// losing precision in the future. The softmax scores are decoded from the fixed-point integers. Fixed-point files do
+// not store raw scores, so these are recomputed from the vectors of e with the metric named by Metric, or Cosine
+// similarity if it is not set. If e is nil, or does not contain the vectors of a pair of CUIs, the raw score is NaN.
+func (v *PrecomputedEmbeddings) Migrate(e *UncompressedEmbeddings) error {
+	encoding := v.encoding()
+	if encoding == EncodingFloat32 {
+		return nil
+	}
+	if encoding != EncodingFixedPoint {
+		return fmt.Errorf("cannot migrate scores from the %s encoding", encoding)
+	}
+
+	metric := CosineMetric
+	if len(v.Metric) > 0 {
+		var err error
+		metric, err = MetricByName(v.Metric)
+		if err != nil {
+			return err
+		}
+	}
+
+	nan := int(math.Float32bits(float32(math.NaN())))
+	matrix := make([][]int, len(v.Matrix))
+	for i, row := range v.Matrix {
+		if len(row) == 0 {
+			continue
+		}
+		var vectors map[string][]float64
+		if e != nil {
+			vectors = e.Embeddings
+		}
+		vec, ok := vectors[Int2CUI(i)]
+		migrated := make([]int, 0, len(row)/2*3)
+		for j := 0; j+2 <= len(row); j += 2 {
+			raw := nan
+			if other, found := vectors[Int2CUI(row[j])]; ok && found {
+				if sim, err := metric.Similarity(e.values(vec), e.values(other)); err == nil {
+					raw = int(math.Float32bits(float32(sim)))
+				}
+			}
+			softmax := int(math.Float32bits(float32(float64(row[j+1]) / fixedPointScale)))
+			migrated = append(migrated, row[j], raw, softmax)
+		}
+		matrix[i] = migrated
+	}
+
+	v.Matrix = matrix
+	v.Cols = v.Cols / 2 * 3
+	v.Encoding = EncodingFloat32
+	v.Metric = metric.Name()
+	return nil
+}
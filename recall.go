@@ -0,0 +1,41 @@
+package cui2vec
+
+// RecallAtK measures how well approximate embeddings (e.g., an HNSWIndex or LSHIndex) reproduce the exact k most
+// similar CUIs of each of the given CUIs. Recall@k is the fraction of the exact top-k CUIs that are also in the
+// approximate top-k, averaged over every CUI that has similar CUIs in the exact embeddings.
+func RecallAtK(approx, exact KEmbeddings, cuis []string, k int) (float64, error) {
+	var (
+		recall float64
+		n      int
+	)
+	for _, cui := range cuis {
+		truth, err := exact.SimilarK(cui, k)
+		if err != nil {
+			return 0, err
+		}
+		if len(truth) == 0 {
+			continue
+		}
+		found, err := approx.SimilarK(cui, k)
+		if err != nil {
+			return 0, err
+		}
+
+		relevant := make(map[string]bool, len(truth))
+		for _, c := range truth {
+			relevant[c.CUI] = true
+		}
+		hits := 0
+		for _, c := range found {
+			if relevant[c.CUI] {
+				hits++
+			}
+		}
+		recall += float64(hits) / float64(len(truth))
+		n++
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return recall / float64(n), nil
+}
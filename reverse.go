@@ -0,0 +1,181 @@
+package cui2vec
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+// ReverseNeighbour is a CUI that lists another CUI among its nearest neighbours. Rank is the position of the other
+// CUI in its neighbours, from 1 for the most similar, and Value is the score of the other CUI at that position.
+type ReverseNeighbour struct {
+	CUI   string
+	Rank  int
+	Value float64
+}
+
+// ReverseIndex answers which CUIs list a CUI among their nearest neighbours, which is how often a query for any of
+// those CUIs would expand to it. A CUI that is the neighbour of many others is a hub, and one that is the neighbour
+// of none is an anti-hub.
+type ReverseIndex struct {
+	// K is the most neighbours of any CUI that were indexed.
+	K int
+
+	reverse map[string][]ReverseNeighbour
+	// vocabulary holds every CUI that has neighbours or is a neighbour, and whether it has neighbours of its own.
+	vocabulary map[string]bool
+}
+
+// newReverseIndex creates an empty index.
+func newReverseIndex() *ReverseIndex {
+	return &ReverseIndex{
+		reverse:    make(map[string][]ReverseNeighbour),
+		vocabulary: make(map[string]bool),
+	}
+}
+
+// add indexes the neighbours of a CUI, from most to least similar.
+func (r *ReverseIndex) add(cui string, neighbours []Concept) {
+	r.vocabulary[cui] = true
+	for i, c := range neighbours {
+		if _, ok := r.vocabulary[c.CUI]; !ok {
+			r.vocabulary[c.CUI] = false
+		}
+		r.reverse[c.CUI] = append(r.reverse[c.CUI], ReverseNeighbour{CUI: cui, Rank: i + 1, Value: c.Value})
+	}
+	if len(neighbours) > r.K {
+		r.K = len(neighbours)
+	}
+}
+
+// sort orders the reverse neighbours of every CUI by rank, and then from highest to lowest score.
+func (r *ReverseIndex) sort() {
+	for _, neighbours := range r.reverse {
+		sort.Slice(neighbours, func(i, j int) bool {
+			if neighbours[i].Rank != neighbours[j].Rank {
+				return neighbours[i].Rank < neighbours[j].Rank
+			}
+			if neighbours[i].Value != neighbours[j].Value {
+				return neighbours[i].Value > neighbours[j].Value
+			}
+			return neighbours[i].CUI < neighbours[j].CUI
+		})
+	}
+}
+
+// NewReverseIndex indexes the neighbours of every row of a pre-computed matrix. The scores are those selected by
+// the Score of the matrix.
+func NewReverseIndex(v *PrecomputedEmbeddings) (*ReverseIndex, error) {
+	r := newReverseIndex()
+	for i, row := range v.Matrix {
+		if row == nil {
+			continue
+		}
+		cui := Int2CUI(i)
+		concepts, err := v.Similar(cui)
+		if err != nil {
+			return nil, err
+		}
+		r.add(cui, concepts)
+	}
+	r.sort()
+	return r, nil
+}
+
+// NewReverseIndexFromEmbeddings finds the k nearest neighbours of every CUI under a metric with AllPairs, and indexes
+// them. The scores are those of the metric.
+func NewReverseIndexFromEmbeddings(v *UncompressedEmbeddings, metric Metric, k int) (*ReverseIndex, error) {
+	if k <= 0 {
+		return nil, errors.New("k must be positive")
+	}
+	a, err := NewAllPairs(v, metric, k)
+	if err != nil {
+		return nil, err
+	}
+	r := newReverseIndex()
+	err = a.Compute(nil, func(n Neighbours) error {
+		r.add(n.CUI, n.Concepts)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.sort()
+	return r, nil
+}
+
+// ReverseSimilar returns the CUIs that list a CUI among their nearest neighbours, ordered by the rank of the CUI in
+// their neighbours and then by score.
+func (r *ReverseIndex) ReverseSimilar(cui string) ([]ReverseNeighbour, error) {
+	if _, err := CUI2Int(cui); err != nil {
+		return nil, err
+	}
+	return r.reverse[cui], nil
+}
+
+// Occurrences is the number of CUIs that list a CUI among their nearest neighbours, known as its k-occurrence.
+func (r *ReverseIndex) Occurrences(cui string) int {
+	return len(r.reverse[cui])
+}
+
+// Hubness summarises the k-occurrences of the CUIs in an index. The vocabulary is every CUI that has neighbours or
+// is a neighbour. A skewness well above zero means that a few hubs are the neighbours of a large share of the
+// vocabulary.
+type Hubness struct {
+	// CUIs is the size of the vocabulary, and Indexed is how many of those have neighbours.
+	CUIs    int
+	Indexed int
+	// K is the most neighbours of any CUI.
+	K int
+	// Mean, StdDev and Skewness describe the distribution of the k-occurrences over the vocabulary.
+	Mean     float64
+	StdDev   float64
+	Skewness float64
+	// AntiHubs is the number of CUIs that are not the neighbour of any CUI.
+	AntiHubs int
+	// Hubs are the CUIs with the highest k-occurrences, where the Value of each is its k-occurrence.
+	Hubs []Concept
+}
+
+// Hubness computes the hubness statistics of the index, listing the n CUIs with the highest k-occurrences as hubs.
+func (r *ReverseIndex) Hubness(n int) Hubness {
+	h := Hubness{CUIs: len(r.vocabulary), K: r.K}
+	if h.CUIs == 0 {
+		return h
+	}
+
+	hubs := newTopK(n)
+	counts := make([]float64, 0, len(r.vocabulary))
+	for cui, indexed := range r.vocabulary {
+		if indexed {
+			h.Indexed++
+		}
+		c := float64(len(r.reverse[cui]))
+		if c == 0 {
+			h.AntiHubs++
+		}
+		counts = append(counts, c)
+		h.Mean += c
+		if n > 0 {
+			hubs.push(Concept{CUI: cui, Value: c})
+		}
+	}
+	h.Mean /= float64(len(counts))
+
+	var m2, m3 float64
+	for _, c := range counts {
+		d := c - h.Mean
+		m2 += d * d
+		m3 += d * d * d
+	}
+	m2 /= float64(len(counts))
+	m3 /= float64(len(counts))
+	h.StdDev = math.Sqrt(m2)
+	if m2 > 0 {
+		h.Skewness = m3 / math.Pow(m2, 1.5)
+	}
+	if n > 0 {
+		h.Hubs = hubs.sorted()
+	}
+	return h
+}
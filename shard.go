@@ -0,0 +1,91 @@
+package cui2vec
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ShardOf returns the shard, numbered from 1 to shards, whose pre-computed distances hold the row of a CUI. CUIs are
+// divided between shards by their number, so every CUI of a model is in exactly one shard.
+func ShardOf(cui string, shards int) (int, error) {
+	if shards < 1 {
+		return 0, fmt.Errorf("invalid number of shards %d", shards)
+	}
+	c, err := CUI2Int(cui)
+	if err != nil {
+		return 0, err
+	}
+	return c%shards + 1, nil
+}
+
+// MergePrecomputed combines the shards of pre-computed distances into one matrix. Every shard must have been
+// computed from the same model, with the same columns, encoding and metric, and either all padded or all variable
+// rows. Each of the shards must be given exactly once, and must hold every row it was expected to, and only the rows
+// of its own CUIs, so that no row is missing or in more than one shard.
+func MergePrecomputed(shards ...*PrecomputedEmbeddings) (*PrecomputedEmbeddings, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("no shards to merge")
+	}
+	first := shards[0]
+	if first.Shards != len(shards) {
+		return nil, fmt.Errorf("expected %d shards, got %d", first.Shards, len(shards))
+	}
+
+	merged := &PrecomputedEmbeddings{
+		Cols:         first.Cols,
+		Encoding:     first.encoding(),
+		Metric:       first.Metric,
+		Fingerprint:  first.Fingerprint,
+		VariableRows: first.VariableRows,
+	}
+	seen := make([]bool, len(shards)+1)
+	for _, s := range shards {
+		switch {
+		case s.Shards != first.Shards:
+			return nil, fmt.Errorf("shard %d is one of %d shards, but shard %d is one of %d", s.Shard, s.Shards, first.Shard, first.Shards)
+		case s.Shard < 1 || s.Shard > s.Shards:
+			return nil, fmt.Errorf("invalid shard %d of %d", s.Shard, s.Shards)
+		case seen[s.Shard]:
+			return nil, fmt.Errorf("shard %d is given more than once", s.Shard)
+		case s.Fingerprint != first.Fingerprint:
+			return nil, fmt.Errorf("shard %d was computed from a different model to shard %d", s.Shard, first.Shard)
+		case s.Cols != first.Cols || s.encoding() != first.encoding():
+			return nil, fmt.Errorf("shard %d has %d columns of %s scores, but shard %d has %d columns of %s scores",
+				s.Shard, s.Cols, s.encoding(), first.Shard, first.Cols, first.encoding())
+		case s.Metric != first.Metric:
+			return nil, fmt.Errorf("shard %d has %s scores, but shard %d has %s scores", s.Shard, s.Metric, first.Shard, first.Metric)
+		case s.VariableRows != first.VariableRows:
+			// Padded rows cannot hold the empty rows of CUIs without neighbours that variable rows record.
+			return nil, fmt.Errorf("shard %d has %s rows, but shard %d has %s rows", s.Shard, s.rowLayout(), first.Shard, first.rowLayout())
+		}
+		seen[s.Shard] = true
+
+		rows := 0
+		for i, row := range s.Matrix {
+			if row == nil {
+				continue
+			}
+			if shard := i%s.Shards + 1; shard != s.Shard {
+				return nil, fmt.Errorf("shard %d has the row of %s, which belongs to shard %d", s.Shard, Int2CUI(i), shard)
+			}
+			for len(merged.Matrix) <= i {
+				merged.Matrix = append(merged.Matrix, nil)
+			}
+			merged.Matrix[i] = row
+			rows++
+		}
+		if rows != s.Expected {
+			return nil, fmt.Errorf("shard %d has %d rows, but %d were expected", s.Shard, rows, s.Expected)
+		}
+		merged.Expected += rows
+	}
+	return merged, nil
+}
+
+// rowLayout describes whether rows are padded or variable.
+func (v *PrecomputedEmbeddings) rowLayout() string {
+	if v.VariableRows {
+		return "variable"
+	}
+	return "padded"
+}
@@ -1,39 +1,91 @@
 package cui2vec
 
 import (
-	"math"
 	"fmt"
 	"gonum.org/v1/gonum/floats"
+	"math"
+	"strings"
 )
 
-// product returns a vector of element-wise products of two input vectors.
-func product(x, y []float64) ([]float64, error) {
-	if len(x) != len(y) {
-		return nil, fmt.Errorf("x and y have unequal lengths: %d / %d", len(x), len(y))
-	}
+// Metric is a measure of how similar two vectors are. Larger values of Similarity always indicate more similar
+// vectors, so metrics that are distances (e.g., Euclidean) are negated.
+type Metric interface {
+	// Name is the name used to select the metric, e.g., with MetricByName.
+	Name() string
+	// Similarity computes the similarity between two vectors.
+	Similarity(x, y []float64) (float64, error)
+}
 
-	p := make([]float64, len(x))
-	for i := range x {
-		p[i] = x[i] * y[i]
-	}
-	return p, nil
+// metric is a Metric implemented by a similarity or distance function.
+type metric struct {
+	name     string
+	fn       func(x, y []float64) (float64, error)
+	distance bool
+}
+
+func (m *metric) Name() string {
+	return m.name
 }
 
-// dotProduct returns the dot product of two vectors.
-func dotProduct(x, y []float64) (float64, error) {
-	p, err := product(x, y)
+func (m *metric) Similarity(x, y []float64) (float64, error) {
+	s, err := m.fn(x, y)
 	if err != nil {
 		return 0, err
 	}
-	return floats.Sum(p), nil
+	if m.distance {
+		return -s, nil
+	}
+	return s, nil
+}
+
+var (
+	// CosineMetric compares vectors by Cosine similarity.
+	CosineMetric Metric = &metric{name: "cosine", fn: Cosine}
+	// DotProductMetric compares vectors by their DotProduct.
+	DotProductMetric Metric = &metric{name: "dot", fn: DotProduct}
+	// EuclideanMetric compares vectors by their negated Euclidean distance.
+	EuclideanMetric Metric = &metric{name: "euclidean", fn: Euclidean, distance: true}
+	// ManhattanMetric compares vectors by their negated Manhattan distance.
+	ManhattanMetric Metric = &metric{name: "manhattan", fn: Manhattan, distance: true}
+	// AngularMetric compares vectors by their negated Angular distance.
+	AngularMetric Metric = &metric{name: "angular", fn: Angular, distance: true}
+	// PearsonMetric compares vectors by their Pearson correlation.
+	PearsonMetric Metric = &metric{name: "pearson", fn: Pearson}
+)
+
+// Metrics are all of the metrics that can be selected by name.
+var Metrics = []Metric{CosineMetric, DotProductMetric, EuclideanMetric, ManhattanMetric, AngularMetric, PearsonMetric}
+
+// MetricByName returns the metric with the given name, e.g., "cosine".
+func MetricByName(name string) (Metric, error) {
+	var names []string
+	for _, m := range Metrics {
+		if m.Name() == name {
+			return m, nil
+		}
+		names = append(names, m.Name())
+	}
+	return nil, fmt.Errorf("unrecognised metric %s, must be one of %s", name, strings.Join(names, ", "))
+}
+
+// DotProduct returns the dot product of two vectors.
+func DotProduct(x, y []float64) (float64, error) {
+	if len(x) != len(y) {
+		return 0, fmt.Errorf("x and y have unequal lengths: %d / %d", len(x), len(y))
+	}
+	return floats.Dot(x, y), nil
 }
 
 // norm returns the vector norm.  Use pow = 2.0 for Euclidean.
 func norm(x []float64, pow float64) float64 {
+	if pow == 2 {
+		return math.Sqrt(floats.Dot(x, x))
+	}
+
 	s := 0.0
 
 	for _, v := range x {
-		s += math.Pow(v, pow)
+		s += math.Pow(math.Abs(v), pow)
 	}
 
 	return math.Pow(s, 1/pow)
@@ -41,7 +93,7 @@ func norm(x []float64, pow float64) float64 {
 
 // Cosine returns the cosine similarity between two vectors.
 func Cosine(x, y []float64) (float64, error) {
-	d, err := dotProduct(x, y)
+	d, err := DotProduct(x, y)
 	if err != nil {
 		return 0, err
 	}
@@ -51,3 +103,48 @@ func Cosine(x, y []float64) (float64, error) {
 
 	return d / (xNorm * yNorm), nil
 }
+
+// Euclidean returns the Euclidean distance between two vectors.
+func Euclidean(x, y []float64) (float64, error) {
+	if len(x) != len(y) {
+		return 0, fmt.Errorf("x and y have unequal lengths: %d / %d", len(x), len(y))
+	}
+	return floats.Distance(x, y, 2), nil
+}
+
+// Manhattan returns the Manhattan (city block) distance between two vectors.
+func Manhattan(x, y []float64) (float64, error) {
+	if len(x) != len(y) {
+		return 0, fmt.Errorf("x and y have unequal lengths: %d / %d", len(x), len(y))
+	}
+	return floats.Distance(x, y, 1), nil
+}
+
+// Angular returns the angular distance between two vectors, which is the angle between them divided by pi.
+func Angular(x, y []float64) (float64, error) {
+	c, err := Cosine(x, y)
+	if err != nil {
+		return 0, err
+	}
+	// Rounding can push the cosine just outside of [-1, 1].
+	c = math.Max(-1, math.Min(1, c))
+	return math.Acos(c) / math.Pi, nil
+}
+
+// Pearson returns the Pearson correlation coefficient between two vectors.
+func Pearson(x, y []float64) (float64, error) {
+	if len(x) != len(y) {
+		return 0, fmt.Errorf("x and y have unequal lengths: %d / %d", len(x), len(y))
+	}
+	n := float64(len(x))
+	xMean, yMean := floats.Sum(x)/n, floats.Sum(y)/n
+
+	var cov, xVar, yVar float64
+	for i := range x {
+		dx, dy := x[i]-xMean, y[i]-yMean
+		cov += dx * dy
+		xVar += dx * dx
+		yVar += dy * dy
+	}
+	return cov / math.Sqrt(xVar*yVar), nil
+}
@@ -18,3 +18,46 @@ func Softmax(z []Concept) []Concept {
 	}
 	return softmax
 }
+
+// logSumExp accumulates the log of the sum of the exponentials of a stream of values, without overflowing for large
+// values. It allows the softmax of a value to be computed without keeping every value in memory.
+type logSumExp struct {
+	max float64
+	sum float64
+}
+
+// add accumulates a value.
+func (l *logSumExp) add(x float64) {
+	if l.sum == 0 {
+		l.max, l.sum = x, 1
+		return
+	}
+	if x > l.max {
+		l.sum = l.sum*math.Exp(l.max-x) + 1
+		l.max = x
+		return
+	}
+	l.sum += math.Exp(x - l.max)
+}
+
+// merge accumulates the values of another logSumExp.
+func (l *logSumExp) merge(o logSumExp) {
+	if o.sum == 0 {
+		return
+	}
+	if l.sum == 0 {
+		*l = o
+		return
+	}
+	if o.max > l.max {
+		l.sum = l.sum*math.Exp(l.max-o.max) + o.sum
+		l.max = o.max
+		return
+	}
+	l.sum += o.sum * math.Exp(o.max-l.max)
+}
+
+// softmax returns the softmax of x relative to the accumulated values.
+func (l logSumExp) softmax(x float64) float64 {
+	return math.Exp(x-l.max) / l.sum
+}
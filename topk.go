@@ -0,0 +1,87 @@
+package cui2vec
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// conceptHeap is a min-heap of concepts ordered by score, where ties are broken by CUI.
+type conceptHeap []Concept
+
+func (h conceptHeap) Len() int {
+	return len(h)
+}
+
+func (h conceptHeap) Less(i, j int) bool {
+	return worse(h[i], h[j])
+}
+
+func (h conceptHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *conceptHeap) Push(x interface{}) {
+	*h = append(*h, x.(Concept))
+}
+
+func (h *conceptHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// worse reports whether concept a should be ranked below concept b.
+func worse(a, b Concept) bool {
+	if a.Value != b.Value {
+		return a.Value < b.Value
+	}
+	return a.CUI > b.CUI
+}
+
+// topK keeps the k highest scoring concepts pushed to it. When k <= 0, every concept is kept.
+type topK struct {
+	k int
+	h conceptHeap
+}
+
+func newTopK(k int) *topK {
+	t := &topK{k: k}
+	if k > 0 {
+		t.h = make(conceptHeap, 0, k)
+	}
+	return t
+}
+
+// push offers a concept to the heap, replacing the lowest scoring concept if the heap is full.
+func (t *topK) push(c Concept) {
+	if t.k <= 0 {
+		t.h = append(t.h, c)
+		return
+	}
+	if len(t.h) < t.k {
+		heap.Push(&t.h, c)
+		return
+	}
+	if worse(t.h[0], c) {
+		t.h[0] = c
+		heap.Fix(&t.h, 0)
+	}
+}
+
+// merge pushes every concept retained by o into t.
+func (t *topK) merge(o *topK) {
+	for _, c := range o.h {
+		t.push(c)
+	}
+}
+
+// sorted returns the retained concepts from highest to lowest score.
+func (t *topK) sorted() []Concept {
+	concepts := make([]Concept, len(t.h))
+	copy(concepts, t.h)
+	sort.Slice(concepts, func(i, j int) bool {
+		return worse(concepts[j], concepts[i])
+	})
+	return concepts
+}
@@ -2,20 +2,102 @@ package cui2vec
 
 import (
 	"bufio"
-	"bytes"
+	"encoding/binary"
 	"encoding/csv"
 	"fmt"
+	"gonum.org/v1/gonum/floats"
+	"hash/fnv"
 	"io"
+	"math"
 	"runtime"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 )
 
+// LoadPolicy determines how LoadModel behaves when a line of a model file cannot be parsed.
+type LoadPolicy int
+
+const (
+	// FailFast stops loading at the first line that cannot be parsed.
+	FailFast LoadPolicy = iota
+	// SkipInvalid skips lines that cannot be parsed, recording them in the LoadReport.
+	SkipInvalid
+	// StopAfterN skips lines that cannot be parsed until MaxErrors of them have been seen, and then stops at the last
+	// of them.
+	StopAfterN
+)
+
+// LineError describes a line of a model file that could not be parsed. Line is the 1-based line number in the file.
+// Column is the 1-based field that could not be parsed as a float, or the character position of malformed csv.
+type LineError struct {
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %v", e.Line, e.Column, e.Err)
+}
+
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// LoadReport summarises the lines read by LoadModel.
+type LoadReport struct {
+	Lines   int
+	Loaded  int
+	Skipped []*LineError
+}
+
+// UncompressedEmbeddings are the vectors of a cui2vec model held in memory. The Embeddings map is always populated;
+// when Storage is DenseStorage, the vectors are also laid out as the rows of the Dense matrix.
+// When Normalise is true, every vector is L2-normalised as it is loaded, and when CacheNorms is true, the norm of every
+// vector is stored in Norms. Either way, Cosine similarity no longer needs to compute the norm of every vector.
+//
+// Vectors read by LoadModel begin with a zero in place of the CUI column of the file, as they always have, so each
+// vector has one more value than the model has dimensions. When DropCUIColumn is true or Storage is DenseStorage,
+// vectors hold only the values of the model. Formats without a CUI column, such as word2vec and NumPy, set
+// DropCUIColumn as they load, and models are always written without the zero.
 type UncompressedEmbeddings struct {
 	SkipFirst  bool
 	Comma      rune
+	Policy     LoadPolicy
+	MaxErrors  int
+	Report     LoadReport
+	Metric     Metric
+	Storage    Storage
+	Normalise  bool
+	CacheNorms bool
+	Dense      *DenseMatrix
+	Norms      map[string]float64
 	Embeddings map[string][]float64
+
+	// DropCUIColumn leaves out the zero that stands in for the CUI column at the start of each vector.
+	DropCUIColumn bool
+
+	normalised bool
+}
+
+// hasCUIColumn reports whether each vector begins with the zero that stands in for the CUI column.
+func (v *UncompressedEmbeddings) hasCUIColumn() bool {
+	return !v.DropCUIColumn && v.Storage != DenseStorage
+}
+
+// values returns the values of a vector of the model, without the zero that stands in for the CUI column.
+func (v *UncompressedEmbeddings) values(vec []float64) []float64 {
+	if v.hasCUIColumn() && len(vec) > 0 {
+		return vec[1:]
+	}
+	return vec
+}
+
+// line is a single numbered line of a model file.
+type line struct {
+	n    int
+	text string
 }
 
 // LoadModel a cui2vec pre-trained model into memory.
@@ -24,113 +106,385 @@ type UncompressedEmbeddings struct {
 // which was downloaded from:
 //	https://figshare.com/s/00d69861786cd0156d81
 // is a csv file. The skipFirst parameter determines if the first line of the file should be skipped.
+// Lines that cannot be parsed are handled according to the Policy of the embeddings, and are returned as a *LineError.
+// The lines that were read and skipped are recorded in the Report.
 func (v *UncompressedEmbeddings) LoadModel(r io.Reader) error {
 	scanner := bufio.NewScanner(r)
-	if v.SkipFirst {
-		scanner.Scan()
-	}
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
 
 	concurrency := runtime.NumCPU()
-	var mu sync.Mutex
-	queue := make(chan string)
-	complete := make(chan bool)
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		once    sync.Once
+		stopped bool
+		scanErr error
+		report  LoadReport
+	)
+	queue := make(chan line)
+	done := make(chan struct{})
 	embeddings := make(map[string][]float64)
 
+	stop := func() {
+		once.Do(func() {
+			stopped = true
+			close(done)
+		})
+	}
+
 	// Read the pre-trained vector file line by line.
 	go func() {
+		defer close(queue)
+		n := 0
 		for scanner.Scan() {
-			queue <- scanner.Text()
+			n++
+			if n == 1 && v.SkipFirst {
+				continue
+			}
+			select {
+			case queue <- line{n: n, text: scanner.Text()}:
+			case <-done:
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			scanErr = fmt.Errorf("line %d: %w", n+1, err)
 		}
-		close(queue)
 	}()
 
 	for i := 0; i < concurrency; i++ {
-		go func(q chan string, complete chan bool) {
-			for b := range q {
-				// Use a csv parser to read the line.
-				reader := csv.NewReader(bytes.NewBufferString(b))
-				reader.Comma = v.Comma
-				line, err := reader.Read()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for l := range queue {
+				cui, vec, err := v.parseLine(l)
+				mu.Lock()
+				report.Lines++
 				if err != nil {
-					panic(err)
-				}
-				if len(line) > 0 {
-					cui := line[0]
-					vec := make([]float64, len(line))
-					for i := 1; i < len(line); i++ {
-						// The features come in as strings and must be parsed.
-						vec[i], err = strconv.ParseFloat(line[i], 64)
-						if err != nil {
-							fmt.Println(len(line), line)
-							panic(err)
-						}
+					report.Skipped = append(report.Skipped, err)
+					if v.Policy == FailFast || (v.Policy == StopAfterN && len(report.Skipped) >= v.MaxErrors) {
+						stop()
 					}
-					mu.Lock()
+				} else if len(cui) > 0 {
 					embeddings[cui] = vec
-					mu.Unlock()
+					report.Loaded++
 				}
+				mu.Unlock()
 			}
-			complete <- true
-		}(queue, complete)
+		}()
 	}
 
-	// Wait until the last goroutine has read from the semaphore.
-	for i := 0; i < concurrency; i++ {
-		<-complete
+	// Wait until the last goroutine has finished parsing.
+	wg.Wait()
+
+	sort.Slice(report.Skipped, func(i, j int) bool {
+		return report.Skipped[i].Line < report.Skipped[j].Line
+	})
+	if stopped {
+		// Lines are parsed out of order, so the line that stopped loading may not be the earliest to fail. Every line
+		// before it was parsed, though, so the errors are cut to those that would have stopped reading line by line.
+		n := 1
+		if v.Policy == StopAfterN && v.MaxErrors > 1 {
+			n = v.MaxErrors
+		}
+		report.Skipped = report.Skipped[:n]
+	}
+	v.Report = report
+
+	if stopped {
+		return report.Skipped[len(report.Skipped)-1]
+	}
+	if scanErr != nil {
+		return scanErr
 	}
+	return v.setEmbeddings(embeddings)
+}
+
+// setEmbeddings replaces the vectors of the embeddings with those that have been loaded, and then normalises, caches
+// norms and compacts them as configured.
+func (v *UncompressedEmbeddings) setEmbeddings(embeddings map[string][]float64) error {
 	v.Embeddings = embeddings
+	v.Dense = nil
+	v.Norms = nil
+	v.normalised = false
+	if v.Normalise {
+		v.NormaliseVectors()
+	}
+	if v.CacheNorms {
+		v.ComputeNorms()
+	}
+	if v.Storage == DenseStorage {
+		return v.Compact()
+	}
 	return nil
 }
 
-// Similar computes cuis that a similar to an input CUI. The distance function used is Cosine similarity. The CUIs are
-// then run through Softmax and sorted.
-func (v *UncompressedEmbeddings) Similar(cui string) ([]Concept, error) {
-	vec := v.Embeddings[cui]
-	var cuis []Concept
-	i := 0
-
-	concurrency := runtime.NumCPU() * 2
-	sem := make(chan bool, concurrency)
-	var mu sync.Mutex
-
-	// Compute the Cosine similarity for each value.
-	for vectorCui, vectorVector := range v.Embeddings {
-		sem <- true
-		go func(c string, f []float64) {
-			defer func() { <-sem }()
-			if c != cui {
-				sim, err := Cosine(vec, f)
-				if err != nil {
-					return
+// parseLine reads a CUI and its vector from a single line of a model file. Empty lines result in an empty CUI.
+// Trailing whitespace, which would otherwise be read as an empty value, is ignored.
+func (v *UncompressedEmbeddings) parseLine(l line) (string, []float64, *LineError) {
+	// Use a csv parser to read the line.
+	reader := csv.NewReader(strings.NewReader(strings.TrimRight(l.text, " \t\r")))
+	reader.Comma = v.Comma
+	record, err := reader.Read()
+	if err == io.EOF {
+		return "", nil, nil
+	}
+	if err != nil {
+		column := 0
+		if pe, ok := err.(*csv.ParseError); ok {
+			column = pe.Column
+			err = pe.Err
+		}
+		return "", nil, &LineError{Line: l.n, Column: column, Err: err}
+	}
+
+	// Unless it is dropped, the first value of each vector stands in for the CUI column and is always zero.
+	cui := record[0]
+	offset := 0
+	if !v.hasCUIColumn() {
+		offset = 1
+	}
+	vec := make([]float64, len(record)-offset)
+	for i := 1; i < len(record); i++ {
+		// The features come in as strings and must be parsed.
+		vec[i-offset], err = strconv.ParseFloat(record[i], 64)
+		if err != nil {
+			return "", nil, &LineError{Line: l.n, Column: i + 1, Err: err}
+		}
+	}
+	return cui, vec, nil
+}
+
+// scanBatch is the number of vectors handed to a worker at a time by scan.
+const scanBatch = 512
+
+// scan calls fn for every vector in the embeddings, distributing the vectors across a number of workers. Each call
+// to fn receives the index of the worker it is running on, so workers can accumulate results without locking.
+// When the vectors are held in a dense matrix, each worker scans blocks of consecutive rows.
+func (v *UncompressedEmbeddings) scan(workers int, fn func(worker int, cui string, vec []float64)) {
+	if m := v.dense(); m != nil {
+		scanDense(m, workers, fn)
+		return
+	}
+
+	type entry struct {
+		cui string
+		vec []float64
+	}
+	batches := make(chan []entry, workers)
+
+	go func() {
+		batch := make([]entry, 0, scanBatch)
+		for cui, vec := range v.Embeddings {
+			batch = append(batch, entry{cui: cui, vec: vec})
+			if len(batch) == scanBatch {
+				batches <- batch
+				batch = make([]entry, 0, scanBatch)
+			}
+		}
+		if len(batch) > 0 {
+			batches <- batch
+		}
+		close(batches)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for batch := range batches {
+				for _, e := range batch {
+					fn(worker, e.cui, e.vec)
 				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
 
-				if len(c) == 0 {
-					return
+// scanDense calls fn for every row of a dense matrix, distributing blocks of consecutive rows across workers.
+func scanDense(m *DenseMatrix, workers int, fn func(worker int, cui string, vec []float64)) {
+	blocks := make(chan int, workers)
+	go func() {
+		for i := 0; i < m.Len(); i += scanBatch {
+			blocks <- i
+		}
+		close(blocks)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for start := range blocks {
+				end := start + scanBatch
+				if end > m.Len() {
+					end = m.Len()
 				}
+				for row := start; row < end; row++ {
+					fn(worker, m.CUIs[row], m.Row(row))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
 
-				mu.Lock()
-				cuis = append(cuis, Concept{
-					CUI:   c,
-					Value: sim,
-				})
-				i++
-				mu.Unlock()
+// metric returns the Metric used for similarity, which is Cosine unless otherwise specified.
+func (v *UncompressedEmbeddings) metric() Metric {
+	if v.Metric == nil {
+		return CosineMetric
+	}
+	return v.Metric
+}
+
+// NormaliseVectors L2-normalises every vector in place, so that the Cosine similarity of two vectors is their dot
+// product. Note that this also changes the results of metrics other than Cosine.
+func (v *UncompressedEmbeddings) NormaliseVectors() {
+	for _, vec := range v.Embeddings {
+		if n := norm(vec, 2); n > 0 {
+			floats.Scale(1/n, vec)
+		}
+	}
+	v.Norms = nil
+	v.normalised = true
+}
+
+// ComputeNorms caches the L2 norm of every vector in Norms, so that the norms are not recomputed for every Cosine
+// similarity. ComputeNorms must be called again if the vectors are modified.
+func (v *UncompressedEmbeddings) ComputeNorms() {
+	norms := make(map[string]float64, len(v.Embeddings))
+	for cui, vec := range v.Embeddings {
+		norms[cui] = norm(vec, 2)
+	}
+	v.Norms = norms
+}
+
+// scorer returns a function that scores vectors of the embeddings against a query vector with metric m. Only the
+// values of the vectors are scored, as the zero in place of the CUI column would change metrics such as Pearson.
+// Cosine similarity is computed as a dot product when the vectors are normalised, or from the cached norms when they
+// are available.
+func (v *UncompressedEmbeddings) scorer(m Metric, query []float64) func(cui string, vec []float64) (float64, error) {
+	query = v.values(query)
+	if m != CosineMetric {
+		return func(cui string, vec []float64) (float64, error) {
+			return m.Similarity(query, v.values(vec))
+		}
+	}
+	if v.normalised {
+		return func(cui string, vec []float64) (float64, error) {
+			return DotProduct(query, v.values(vec))
+		}
+	}
+	if v.Norms != nil {
+		qNorm := norm(query, 2)
+		return func(cui string, vec []float64) (float64, error) {
+			vec = v.values(vec)
+			d, err := DotProduct(query, vec)
+			if err != nil {
+				return 0, err
 			}
-		}(vectorCui, vectorVector)
+			n, ok := v.Norms[cui]
+			if !ok {
+				n = norm(vec, 2)
+			}
+			return d / (qNorm * n), nil
+		}
 	}
+	return func(cui string, vec []float64) (float64, error) {
+		return Cosine(query, v.values(vec))
+	}
+}
 
-	// Wait until the last goroutine has read from the semaphore.
-	for i := 0; i < cap(sem); i++ {
-		sem <- true
+// similar computes the k CUIs most similar to an input CUI using metric m. Each worker keeps a bounded heap of the best CUIs it has
+// seen, and the heaps are merged once every vector has been compared. When softmax is true, the scores are
+// normalised by the softmax over every CUI, not only the k that are returned.
+func (v *UncompressedEmbeddings) similar(cui string, k int, m Metric, softmax bool) ([]Concept, error) {
+	vec, ok := v.Embeddings[cui]
+	if !ok {
+		return []Concept{}, nil
 	}
 
-	// Softmax the values.
-	cuis = Softmax(cuis)
+	workers := runtime.NumCPU()
+	heaps := make([]*topK, workers)
+	sums := make([]logSumExp, workers)
+	for i := range heaps {
+		heaps[i] = newTopK(k)
+	}
 
-	// Sort the values.
-	sort.Slice(cuis, func(i, j int) bool {
-		return cuis[i].Value > cuis[j].Value
+	// Compute the similarity for each value.
+	score := v.scorer(m, vec)
+	v.scan(workers, func(w int, c string, f []float64) {
+		if c == cui || len(c) == 0 {
+			return
+		}
+		sim, err := score(c, f)
+		if err != nil || math.IsNaN(sim) {
+			return
+		}
+		heaps[w].push(Concept{CUI: c, Value: sim})
+		sums[w].add(sim)
 	})
 
-	return cuis, nil
+	for i := 1; i < workers; i++ {
+		heaps[0].merge(heaps[i])
+		sums[0].merge(sums[i])
+	}
+	concepts := heaps[0].sorted()
+
+	// Softmax the values.
+	if softmax {
+		for i := range concepts {
+			concepts[i].Value = sums[0].softmax(concepts[i].Value)
+		}
+	}
+
+	return concepts, nil
+}
+
+// Similar computes cuis that a similar to an input CUI. The distance function used is the Metric of the embeddings,
+// which is Cosine similarity by default. The CUIs are then run through Softmax and sorted.
+func (v *UncompressedEmbeddings) Similar(cui string) ([]Concept, error) {
+	return v.similar(cui, 0, v.metric(), true)
+}
+
+// SimilarK computes the k cuis most similar to an input CUI, sorted by their raw similarity. Unlike Similar,
+// SimilarK neither sorts nor normalises the scores of every CUI. A k <= 0 returns every CUI.
+func (v *UncompressedEmbeddings) SimilarK(cui string, k int) ([]Concept, error) {
+	return v.similar(cui, k, v.metric(), false)
+}
+
+// SimilarKSoftmax computes the k cuis most similar to an input CUI, where the scores are normalised with the softmax
+// over every CUI. The result is the same as the first k concepts of Similar.
+func (v *UncompressedEmbeddings) SimilarKSoftmax(cui string, k int) ([]Concept, error) {
+	return v.similar(cui, k, v.metric(), true)
+}
+
+// SimilarMetric computes the k cuis most similar to an input CUI, sorted by their raw similarity according to metric
+// m rather than the Metric of the embeddings. A k <= 0 returns every CUI.
+func (v *UncompressedEmbeddings) SimilarMetric(cui string, k int, m Metric) ([]Concept, error) {
+	return v.similar(cui, k, m, false)
+}
+
+// Fingerprint is a hash of the CUIs and vectors of the embeddings, which identifies a model regardless of the order
+// or format it was loaded from.
+func (v *UncompressedEmbeddings) Fingerprint() uint64 {
+	cuis := make([]string, 0, len(v.Embeddings))
+	for cui := range v.Embeddings {
+		cuis = append(cuis, cui)
+	}
+	sort.Strings(cuis)
+
+	h := fnv.New64a()
+	b := make([]byte, 8)
+	for _, cui := range cuis {
+		h.Write(append([]byte(cui), 0))
+		for _, x := range v.values(v.Embeddings[cui]) {
+			binary.LittleEndian.PutUint64(b, math.Float64bits(x))
+			h.Write(b)
+		}
+	}
+	return h.Sum64()
 }
@@ -16,6 +16,13 @@ type SimResponse struct {
 	V []Concept
 }
 
+// AnalogyRequest asks "A is to B as C is to ?", answered with the K best CUIs using Method.
+type AnalogyRequest struct {
+	A, B, C string
+	K       int
+	Method  AnalogyMethod
+}
+
 func NewVecClient(addr string) (*VecClient, error) {
 	client, err := rpc.Dial("tcp", addr)
 	if err != nil {
@@ -38,3 +45,9 @@ func (c *VecClient) Sim(cui string) ([]Concept, error) {
 	err := c.client.Call("EmbeddingsRPC.GetSimilar", cui, vec)
 	return vec.V, err
 }
+
+func (c *VecClient) Analogy(a, b, cui string, k int, method AnalogyMethod) ([]Concept, error) {
+	vec := new(SimResponse)
+	err := c.client.Call("EmbeddingsRPC.GetAnalogy", AnalogyRequest{A: a, B: b, C: cui, K: k, Method: method}, vec)
+	return vec.V, err
+}
@@ -0,0 +1,173 @@
+package cui2vec
+
+import (
+	"errors"
+	"fmt"
+	"gonum.org/v1/gonum/floats"
+	"math"
+	"runtime"
+	"sync"
+)
+
+// WeightedCUI is a CUI in a weighted query. Positive weights draw results towards the CUI, and negative weights push
+// results away from it.
+type WeightedCUI struct {
+	CUI    string
+	Weight float64
+}
+
+// FusionStrategy determines how the CUIs in a weighted query are combined.
+type FusionStrategy int
+
+const (
+	// Centroid compares CUIs to a single query vector, the weighted sum of the unit-length vectors of the query.
+	Centroid FusionStrategy = iota
+	// ScoreFusion scores CUIs by the weighted sum of their similarities to each CUI in the query.
+	ScoreFusion
+)
+
+var errEmptyQuery = errors.New("weighted query contains no cuis")
+
+// SimilarSet computes the k cuis most similar to a weighted set of CUIs, combined according to the strategy.
+// The CUIs in the query are never part of the result. A k <= 0 returns every CUI.
+func (v *UncompressedEmbeddings) SimilarSet(query []WeightedCUI, k int, strategy FusionStrategy) ([]Concept, error) {
+	if len(query) == 0 {
+		return nil, errEmptyQuery
+	}
+
+	vecs := make([][]float64, len(query))
+	exclude := make(map[string]bool, len(query))
+	for i, q := range query {
+		vec, ok := v.Embeddings[q.CUI]
+		if !ok {
+			return nil, fmt.Errorf("%s is not in the embeddings", q.CUI)
+		}
+		vecs[i] = vec
+		exclude[q.CUI] = true
+	}
+
+	m := v.metric()
+	var score func(cui string, d []float64) (float64, error)
+	switch strategy {
+	case Centroid:
+		centroid := make([]float64, len(v.values(vecs[0])))
+		for i, vec := range vecs {
+			vec = v.values(vec)
+			if len(vec) != len(centroid) {
+				return nil, fmt.Errorf("%s has %d dimensions, expected %d", query[i].CUI, len(vec), len(centroid))
+			}
+			n := floats.Norm(vec, 2)
+			if n == 0 {
+				continue
+			}
+			floats.AddScaled(centroid, query[i].Weight/n, vec)
+		}
+		score = func(cui string, d []float64) (float64, error) {
+			return m.Similarity(centroid, v.values(d))
+		}
+	case ScoreFusion:
+		scores := make([]func(cui string, vec []float64) (float64, error), len(vecs))
+		for i, vec := range vecs {
+			scores[i] = v.scorer(m, vec)
+		}
+		score = func(cui string, d []float64) (float64, error) {
+			var s float64
+			for i := range scores {
+				sim, err := scores[i](cui, d)
+				if err != nil {
+					return 0, err
+				}
+				s += query[i].Weight * sim
+			}
+			return s, nil
+		}
+	default:
+		return nil, fmt.Errorf("unrecognised fusion strategy %d", strategy)
+	}
+
+	workers := runtime.NumCPU()
+	heaps := make([]*topK, workers)
+	for i := range heaps {
+		heaps[i] = newTopK(k)
+	}
+
+	v.scan(workers, func(w int, cui string, d []float64) {
+		if exclude[cui] || len(cui) == 0 {
+			return
+		}
+		s, err := score(cui, d)
+		if err != nil || math.IsNaN(s) {
+			return
+		}
+		heaps[w].push(Concept{CUI: cui, Value: s})
+	})
+
+	for i := 1; i < workers; i++ {
+		heaps[0].merge(heaps[i])
+	}
+	return heaps[0].sorted(), nil
+}
+
+// SimilarSet computes the k cuis most similar to a weighted set of CUIs by fusing the pre-computed neighbours of
+// each CUI in the query: each neighbour is scored by the weighted sum of the scores it has in each list. As the
+// vectors are not available, only ScoreFusion is possible. The CUIs in the query are never part of the result.
+// A k <= 0 returns every CUI in the fused lists.
+func (v *PrecomputedEmbeddings) SimilarSet(query []WeightedCUI, k int) ([]Concept, error) {
+	if len(query) == 0 {
+		return nil, errEmptyQuery
+	}
+
+	exclude := make(map[string]bool, len(query))
+	for _, q := range query {
+		exclude[q.CUI] = true
+	}
+
+	scores := make(map[string]float64)
+	for _, q := range query {
+		concepts, err := v.Similar(q.CUI)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range concepts {
+			if exclude[c.CUI] {
+				continue
+			}
+			scores[c.CUI] += q.Weight * c.Value
+		}
+	}
+
+	t := newTopK(k)
+	for cui, s := range scores {
+		t.push(Concept{CUI: cui, Value: s})
+	}
+	return t.sorted(), nil
+}
+
+// SimilarSets computes SimilarSet for a batch of weighted queries concurrently. The i-th result is the answer to
+// the i-th query. The first error encountered is returned.
+func (v *PrecomputedEmbeddings) SimilarSets(queries [][]WeightedCUI, k int) ([][]Concept, error) {
+	results := make([][]Concept, len(queries))
+	errs := make([]error, len(queries))
+
+	sem := make(chan bool, runtime.NumCPU())
+	var wg sync.WaitGroup
+	for i := range queries {
+		sem <- true
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i], errs[i] = v.SimilarSet(queries[i], k)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,150 @@
+package cui2vec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxWord2VecDims is the most dimensions of a vector that LoadWord2Vec accepts, far more than any model has.
+	maxWord2VecDims = 1 << 20
+	// maxWord2VecHint is the most vectors that space is reserved for before they are read, so that the number of
+	// vectors in a corrupt header does not allocate memory.
+	maxWord2VecHint = 1 << 20
+)
+
+// NewWord2VecEmbeddings loads embeddings in the binary format of the original word2vec C tool, which may be
+// compressed.
+func NewWord2VecEmbeddings(r io.Reader) (*UncompressedEmbeddings, error) {
+	v := &UncompressedEmbeddings{
+		Embeddings: make(map[string][]float64),
+	}
+	err := decompressed(r, v.LoadWord2Vec)
+	return v, err
+}
+
+// LoadWord2Vec loads embeddings in the binary format of the original word2vec C tool into memory, replacing any
+// vectors already loaded. The format is a header line containing the number of vectors and the number of
+// dimensions, followed by each token, a space, and its vector as little-endian float32s. Newlines between vectors
+// are optional.
+func (v *UncompressedEmbeddings) LoadWord2Vec(r io.Reader) error {
+	br := bufio.NewReader(r)
+	header, err := br.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("word2vec header: %w", err)
+	}
+	fields := strings.Fields(header)
+	if len(fields) != 2 {
+		return fmt.Errorf("word2vec header must contain the number of vectors and dimensions, got %q", header)
+	}
+	n, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return fmt.Errorf("word2vec header: %w", err)
+	}
+	dims, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return fmt.Errorf("word2vec header: %w", err)
+	}
+	if n <= 0 || dims <= 0 || dims > maxWord2VecDims {
+		return fmt.Errorf("word2vec header has invalid shape %d x %d", n, dims)
+	}
+
+	hint := n
+	if hint > maxWord2VecHint {
+		hint = maxWord2VecHint
+	}
+	embeddings := make(map[string][]float64, hint)
+	b := make([]byte, 4*dims)
+	for i := 0; i < n; i++ {
+		token, err := readWord2VecToken(br)
+		if err != nil {
+			return fmt.Errorf("word2vec vector %d: %w", i+1, err)
+		}
+		if _, err := io.ReadFull(br, b); err != nil {
+			return fmt.Errorf("word2vec vector %d (%s): %w", i+1, token, err)
+		}
+		vec := make([]float64, dims)
+		for j := range vec {
+			vec[j] = float64(math.Float32frombits(binary.LittleEndian.Uint32(b[j*4:])))
+		}
+		embeddings[token] = vec
+	}
+	v.Report = LoadReport{Lines: n, Loaded: len(embeddings)}
+	v.DropCUIColumn = true
+	return v.setEmbeddings(embeddings)
+}
+
+// readWord2VecToken reads a token terminated by a space, skipping any newlines that precede it.
+func readWord2VecToken(br *bufio.Reader) (string, error) {
+	var token []byte
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		if c == ' ' {
+			break
+		}
+		if c == '\n' && len(token) == 0 {
+			continue
+		}
+		token = append(token, c)
+	}
+	if len(token) == 0 {
+		return "", errors.New("empty token")
+	}
+	return string(token), nil
+}
+
+// WriteWord2Vec writes the embeddings in the binary format of the original word2vec C tool, with the vectors ordered
+// by CUI. Every vector must have the same number of dimensions, and vectors are written as float32s.
+func (v *UncompressedEmbeddings) WriteWord2Vec(w io.Writer) error {
+	cuis := make([]string, 0, len(v.Embeddings))
+	for cui := range v.Embeddings {
+		cuis = append(cuis, cui)
+	}
+	sort.Strings(cuis)
+
+	dims := 0
+	if len(cuis) > 0 {
+		dims = len(v.values(v.Embeddings[cuis[0]]))
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := fmt.Fprintf(bw, "%d %d\n", len(cuis), dims); err != nil {
+		return err
+	}
+	b := make([]byte, 4*dims)
+	for _, cui := range cuis {
+		vec := v.values(v.Embeddings[cui])
+		if len(vec) != dims {
+			return fmt.Errorf("%s has %d dimensions, expected %d", cui, len(vec), dims)
+		}
+		if strings.ContainsAny(cui, " \n") {
+			return fmt.Errorf("%q cannot be written to word2vec as it contains whitespace", cui)
+		}
+		for j, x := range vec {
+			binary.LittleEndian.PutUint32(b[j*4:], math.Float32bits(float32(x)))
+		}
+		if _, err := bw.WriteString(cui + " "); err != nil {
+			return err
+		}
+		if _, err := bw.Write(b); err != nil {
+			return err
+		}
+		if err := bw.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}